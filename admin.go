@@ -0,0 +1,270 @@
+package kotori
+
+import (
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/session"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Roles of admin accounts. What each may do is listed in rolePermissions.
+const (
+	RoleOwner     = "owner"
+	RoleEditor    = "editor"
+	RoleAuthor    = "author"
+	RoleModerator = "moderator"
+)
+
+// Permissions guarding the admin routes. Authors have PermissionPostWrite
+// without PermissionPostEditOthers, so they can only change their own posts.
+const (
+	PermissionPostWrite       = "post:write"
+	PermissionPostEditOthers  = "post:edit_others"
+	PermissionIndexWrite      = "index:write"
+	PermissionCommentModerate = "comment:moderate"
+	PermissionUserWrite       = "user:write"
+	PermissionAdminManage     = "admin:manage"
+)
+
+// rolePermissions is the permission matrix of the roles.
+var rolePermissions = map[string][]string{
+	RoleOwner: {PermissionPostWrite, PermissionPostEditOthers, PermissionIndexWrite, PermissionCommentModerate,
+		PermissionUserWrite, PermissionAdminManage},
+	RoleEditor:    {PermissionPostWrite, PermissionPostEditOthers, PermissionIndexWrite, PermissionCommentModerate},
+	RoleAuthor:    {PermissionPostWrite},
+	RoleModerator: {PermissionCommentModerate, PermissionUserWrite},
+}
+
+// scopePermissions lists the permissions granted by each API token scope.
+var scopePermissions = map[string][]string{
+	ScopePostWrite:       {PermissionPostWrite, PermissionPostEditOthers},
+	ScopeIndexWrite:      {PermissionIndexWrite},
+	ScopeCommentModerate: {PermissionCommentModerate, PermissionUserWrite},
+}
+
+var ErrLastOwner = errors.New("the last owner cannot be removed or demoted")
+
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Can reports whether the role of admin grants permission.
+func (admin Admin) Can(permission string) bool {
+	for _, p := range rolePermissions[admin.Role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether a scope of token grants permission.
+func (token APIToken) Can(permission string) bool {
+	for _, scope := range token.ScopeList {
+		for _, p := range scopePermissions[scope] {
+			if p == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func FindAdmins(db *gorm.DB) (admins []Admin, err error) {
+	err = db.Order("id").Find(&admins).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindAdmins")
+		return
+	}
+	return
+}
+
+func FindAdmin(db *gorm.DB, id uint) (admin Admin, err error) {
+	err = db.Where("id = ?", id).First(&admin).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindAdmin")
+		return
+	}
+	return
+}
+
+func FindAdminByUsername(db *gorm.DB, username string) (admin Admin, err error) {
+	err = db.Where("username = ?", username).First(&admin).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindAdminByUsername")
+		return
+	}
+	return
+}
+
+// StoreAdmin creates an admin account. The password of admin must already be
+// hashed.
+func StoreAdmin(db *gorm.DB, admin Admin) (admin_new Admin, err error) {
+	var count int
+	err = db.Model(&Admin{}).Where("username = ?", admin.Username).Count(&count).Error
+	if err == nil && count != 0 {
+		err = ErrNameTaken
+	}
+	if err == nil {
+		err = db.Create(&admin).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "StoreAdmin")
+		return
+	}
+	admin_new = admin
+	return
+}
+
+// UpdateAdmin changes the role, the password, the name and the email of the
+// admin account admin.ID, leaving out the empty ones. The last owner keeps its
+// role.
+func UpdateAdmin(db *gorm.DB, admin Admin) (admin_new Admin, err error) {
+	tx := db.Begin()
+	var old Admin
+	err = tx.Where("id = ?", admin.ID).First(&old).Error
+	if err == nil && admin.Role != "" && admin.Role != RoleOwner && old.Role == RoleOwner {
+		err = checkOtherOwner(tx, old.ID)
+	}
+	if err == nil {
+		err = tx.Model(&old).Updates(Admin{Role: admin.Role, Password: admin.Password, Name: admin.Name, Email: admin.Email}).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "UpdateAdmin")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		err = errors.Wrap(err, "UpdateAdmin")
+		return
+	}
+	admin_new = old
+	return
+}
+
+// RemoveAdmin deletes the admin account id and logs out its sessions. The
+// last owner cannot be removed.
+func RemoveAdmin(db *gorm.DB, manager *session.Manager, id uint) (err error) {
+	tx := db.Begin()
+	var admin Admin
+	err = tx.Where("id = ?", id).First(&admin).Error
+	if err == nil && admin.Role == RoleOwner {
+		err = checkOtherOwner(tx, admin.ID)
+	}
+	if err == nil {
+		err = tx.Delete(&admin).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "RemoveAdmin")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		err = errors.Wrap(err, "RemoveAdmin")
+		return
+	}
+	var sessions []AdminSession
+	err = db.Where("username = ?", admin.Username).Find(&sessions).Error
+	for i := 0; err == nil && i < len(sessions); i++ {
+		if manager != nil {
+			err = manager.GetProvider().SessionDestroy(sessions[i].SID)
+		}
+		if err == nil {
+			err = db.Delete(&sessions[i]).Error
+		}
+	}
+	if err != nil {
+		err = errors.Wrap(err, "RemoveAdmin")
+		return
+	}
+	return
+}
+
+// checkOtherOwner returns ErrLastOwner unless an owner other than id exists.
+func checkOtherOwner(db *gorm.DB, id uint) (err error) {
+	var count int
+	err = db.Model(&Admin{}).Where("role = ? AND id <> ?", RoleOwner, id).Count(&count).Error
+	if err == nil && count == 0 {
+		err = ErrLastOwner
+	}
+	return
+}
+
+// ImportConfigAdmins creates an owner account for each admin of the config
+// file and returns how many were created. It only does so while there are no
+// admin accounts at all, so that accounts removed later do not come back.
+func ImportConfigAdmins(db *gorm.DB, admins []Admin) (imported int, err error) {
+	tx := db.Begin()
+	var count int
+	err = tx.Model(&Admin{}).Count(&count).Error
+	seen := make(map[string]bool)
+	for i := 0; err == nil && count == 0 && i < len(admins); i++ {
+		if seen[admins[i].Username] {
+			continue
+		}
+		seen[admins[i].Username] = true
+		err = tx.Create(&Admin{Username: admins[i].Username, Password: admins[i].Password, Role: RoleOwner}).Error
+		if err == nil {
+			imported++
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "ImportConfigAdmins")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		err = errors.Wrap(err, "ImportConfigAdmins")
+		return
+	}
+	return
+}
+
+// dummyPasswordHash is checked against the password given for an unknown
+// username, so that usernames cannot be told apart by timing.
+var dummyPasswordHash struct {
+	once sync.Once
+	hash string
+}
+
+func checkDummyPassword(password string) {
+	dummyPasswordHash.once.Do(func() {
+		dummyPasswordHash.hash, _ = HashPassword(time.Now().String())
+	})
+	CheckPassword(dummyPasswordHash.hash, password)
+}
+
+// AuthenticateAdmin returns the admin account username if password matches.
+// Passwords stored in plaintext are hashed on the first successful login.
+func AuthenticateAdmin(db *gorm.DB, username string, password string) (admin Admin, ok bool, err error) {
+	admin, err = FindAdminByUsername(db, username)
+	if err != nil {
+		if gorm.IsRecordNotFoundError(errors.Cause(err)) {
+			checkDummyPassword(password)
+			err = nil
+		}
+		return
+	}
+	if !CheckPassword(admin.Password, password) {
+		return
+	}
+	ok = true
+	if !IsPasswordHash(admin.Password) {
+		var hash string
+		hash, err = HashPassword(password)
+		if err == nil {
+			err = db.Model(&admin).UpdateColumn("password", hash).Error
+		}
+		if err != nil {
+			err = errors.Wrap(err, "AuthenticateAdmin")
+			return
+		}
+	}
+	return
+}
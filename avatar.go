@@ -0,0 +1,147 @@
+package kotori
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	AvatarHashMD5    = "md5"
+	AvatarHashSHA256 = "sha256"
+)
+
+// AvatarHash hashes an email address the way Gravatar and Libravatar expect:
+// trimmed and lower-cased, with MD5 unless algorithm is AvatarHashSHA256.
+func AvatarHash(email string, algorithm string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if algorithm == AvatarHashSHA256 {
+		sum := sha256.Sum256([]byte(email))
+		return hex.EncodeToString(sum[:])
+	}
+	sum := md5.Sum([]byte(email))
+	return hex.EncodeToString(sum[:])
+}
+
+// PublicUser is the representation of a User shown to visitors, with the
+// email address replaced by its avatar hash.
+type PublicUser struct {
+	ID         uint   `json:"id"`
+	Name       string `json:"name"`
+	Website    string `json:"website"`
+	Rank       int64  `json:"rank"`
+	Honor      string `json:"honor"`
+	AvatarHash string `json:"avatar_hash"`
+	Avatar     string `json:"avatar,omitempty"`
+}
+
+// Public returns the projection of user for visitors. Users that were not
+// loaded, such as the missing ReplyUser of a top-level comment, get no hash.
+func (user User) Public(cfg AvatarConfig) PublicUser {
+	public := PublicUser{
+		ID:      user.ID,
+		Name:    user.Name,
+		Website: user.Website,
+		Rank:    user.Rank,
+		Honor:   user.Honor,
+	}
+	if user.Email != "" {
+		public.AvatarHash, public.Avatar = avatar(user.Email, cfg)
+	}
+	return public
+}
+
+// avatar returns the avatar hash of email and, when cfg has a URL template,
+// the URL of the avatar.
+func avatar(email string, cfg AvatarConfig) (hash string, url string) {
+	hash = AvatarHash(email, cfg.HASH)
+	if cfg.URL != "" {
+		url = strings.Replace(cfg.URL, "{hash}", hash, -1)
+	}
+	return
+}
+
+// Author is an Admin as shown to visitors on the posts and indexes it wrote
+// or last updated, named after its username when it has no name.
+type Author struct {
+	ID         uint   `json:"id"`
+	Username   string `json:"-"`
+	Name       string `json:"name"`
+	Email      string `json:"-"`
+	AvatarHash string `gorm:"-" json:"avatar_hash"`
+	Avatar     string `gorm:"-" json:"avatar,omitempty"`
+}
+
+func (Author) TableName() string {
+	return "admins"
+}
+
+func (author *Author) AfterFind() (err error) {
+	if author.Name == "" {
+		author.Name = author.Username
+	}
+	return
+}
+
+// SetAvatars fills in the avatars of the authors that were loaded and have an
+// email address.
+func SetAvatars(cfg AvatarConfig, authors ...*Author) {
+	for _, author := range authors {
+		if author == nil || author.Email == "" {
+			continue
+		}
+		author.AvatarHash, author.Avatar = avatar(author.Email, cfg)
+	}
+}
+
+// PublicComment is a Comment whose users are shown as PublicUser. The nil
+// spam fields hide those of the Comment from visitors, and the content and
+// the author of removed comments are left out.
+type PublicComment struct {
+	Comment
+	ReplyUser  PublicUser   `json:"reply_user"`
+	User       PublicUser   `json:"user"`
+	SpamScore  *float64     `json:"spam_score,omitempty"`
+	SpamScores *[]SpamScore `json:"spam_scores,omitempty"`
+	SpamClass  *string      `json:"spam_class,omitempty"`
+}
+
+func (comment Comment) Public(cfg AvatarConfig) PublicComment {
+	if comment.RemovedAt != nil {
+		comment.Content, comment.ContentHTML = "", ""
+		comment.UserID, comment.User = 0, User{}
+	}
+	return PublicComment{
+		Comment:   comment,
+		ReplyUser: comment.ReplyUser.Public(cfg),
+		User:      comment.User.Public(cfg),
+	}
+}
+
+func PublicComments(comments []Comment, cfg AvatarConfig) []PublicComment {
+	public := make([]PublicComment, len(comments))
+	for i := range comments {
+		public[i] = comments[i].Public(cfg)
+	}
+	return public
+}
+
+// PublicCommentNode is a CommentNode whose comments are PublicComment.
+type PublicCommentNode struct {
+	PublicComment
+	Replies     []PublicCommentNode `json:"replies"`
+	MoreReplies *CommentCursor      `json:"more_replies,omitempty"`
+}
+
+func PublicCommentThreads(nodes []*CommentNode, cfg AvatarConfig) []PublicCommentNode {
+	public := make([]PublicCommentNode, len(nodes))
+	for i, node := range nodes {
+		public[i] = PublicCommentNode{
+			PublicComment: node.Comment.Public(cfg),
+			Replies:       PublicCommentThreads(node.Replies, cfg),
+			MoreReplies:   node.MoreReplies,
+		}
+	}
+	return public
+}
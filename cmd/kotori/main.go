@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/satouriko/kotori"
+)
+
+const usage = `Usage: kotori [-config config.toml] <command> [arguments]
+
+Commands:
+  serve                             start the HTTP server
+  migrate                           create or update database tables
+  admin list                        list the admins and their roles
+  admin add <username> [password]   add an admin with the owner role
+  admin remove <username>           remove an admin
+  admin passwd <username> [password]
+                                    change the password of an admin
+  admin role <username> <role>      make an admin an owner, editor, author
+                                    or moderator
+  backup <file>                     write a copy of the database to file
+  import <file>                     load records from a JSON dump
+  export [file]                     write all records as a JSON dump
+  search rebuild                    rebuild the full-text search index
+  rank recompute                    rebuild user ranks from the rank event
+                                    ledger under the current rules
+
+Passwords not given as arguments are read from standard input. They are
+stored as argon2id hashes.
+`
+
+var configPath string
+
+func main() {
+	flag.StringVar(&configPath, "config", "config.toml", "path to the configuration file")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "serve":
+		err = serve()
+	case "migrate":
+		err = migrate()
+	case "admin":
+		err = admin(args)
+	case "backup":
+		err = backup(args)
+	case "import":
+		err = importDump(args)
+	case "export":
+		err = exportDump(args)
+	case "search":
+		err = search(args)
+	case "rank":
+		err = rank(args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "kotori:", err)
+		os.Exit(1)
+	}
+}
+
+func serve() (err error) {
+	cfg, err := kotori.LoadConfig(configPath)
+	if err != nil {
+		return
+	}
+	s, err := kotori.NewServer(cfg)
+	if err != nil {
+		return
+	}
+	defer s.Close()
+	return s.ListenAndServe()
+}
+
+func openDatabase() (db *gorm.DB, err error) {
+	cfg, err := kotori.LoadConfig(configPath)
+	if err != nil {
+		return
+	}
+	return kotori.OpenDatabase(cfg)
+}
+
+func migrate() (err error) {
+	db, err := openDatabase()
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	return kotori.Migrate(db)
+}
+
+func admin(args []string) (err error) {
+	if len(args) < 1 {
+		return fmt.Errorf("admin: expected a subcommand")
+	}
+	cfg, err := kotori.LoadConfig(configPath)
+	if err != nil {
+		return
+	}
+	db, err := kotori.OpenDatabase(cfg)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	err = kotori.Migrate(db)
+	if err == nil {
+		_, err = kotori.ImportConfigAdmins(db, cfg.ADMIN)
+	}
+	if err != nil {
+		return
+	}
+	if args[0] == "list" {
+		admins, err := kotori.FindAdmins(db)
+		if err != nil {
+			return err
+		}
+		for _, a := range admins {
+			fmt.Printf("%s\t%s\n", a.Username, a.Role)
+		}
+		return nil
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("admin %s: expected a username", args[0])
+	}
+	username := args[1]
+	a, err := kotori.FindAdminByUsername(db, username)
+	found := err == nil
+	switch args[0] {
+	case "add":
+		if found {
+			return fmt.Errorf("admin add: %s already exists", username)
+		}
+		password, err := passwordArg(args)
+		if err != nil {
+			return err
+		}
+		_, err = kotori.StoreAdmin(db, kotori.Admin{Username: username, Password: password, Role: kotori.RoleOwner})
+		return err
+	case "remove":
+		if !found {
+			return fmt.Errorf("admin remove: no such admin %s", username)
+		}
+		return kotori.RemoveAdmin(db, nil, a.ID)
+	case "passwd":
+		if !found {
+			return fmt.Errorf("admin passwd: no such admin %s", username)
+		}
+		password, err := passwordArg(args)
+		if err != nil {
+			return err
+		}
+		_, err = kotori.UpdateAdmin(db, kotori.Admin{ID: a.ID, Password: password})
+		return err
+	case "role":
+		if !found {
+			return fmt.Errorf("admin role: no such admin %s", username)
+		}
+		if len(args) != 3 || !kotori.ValidRole(args[2]) {
+			return fmt.Errorf("admin role: expected owner, editor, author or moderator")
+		}
+		_, err = kotori.UpdateAdmin(db, kotori.Admin{ID: a.ID, Role: args[2]})
+		return err
+	default:
+		return fmt.Errorf("admin: unknown subcommand %s", args[0])
+	}
+}
+
+// passwordArg reads the password of an admin command and returns its hash.
+func passwordArg(args []string) (password string, err error) {
+	if len(args) > 2 {
+		password = args[2]
+	} else {
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return
+		}
+		err = nil
+		password = strings.TrimRight(password, "\r\n")
+	}
+	if password == "" {
+		err = fmt.Errorf("password must not be empty")
+		return
+	}
+	return kotori.HashPassword(password)
+}
+
+func backup(args []string) (err error) {
+	if len(args) != 1 {
+		return fmt.Errorf("backup: expected a destination file")
+	}
+	db, err := openDatabase()
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	return kotori.BackupDatabase(db, args[0])
+}
+
+func importDump(args []string) (err error) {
+	if len(args) != 1 {
+		return fmt.Errorf("import: expected a dump file")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	db, err := openDatabase()
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	err = kotori.Migrate(db)
+	if err != nil {
+		return
+	}
+	return kotori.ImportDump(db, f)
+}
+
+func exportDump(args []string) (err error) {
+	db, err := openDatabase()
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	w := io.Writer(os.Stdout)
+	if len(args) > 0 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return kotori.ExportDump(db, w)
+}
+
+func search(args []string) (err error) {
+	if len(args) != 1 || args[0] != "rebuild" {
+		return fmt.Errorf("search: expected rebuild")
+	}
+	db, err := openDatabase()
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	err = kotori.Migrate(db)
+	if err != nil {
+		return
+	}
+	return kotori.RebuildSearchIndex(db)
+}
+
+func rank(args []string) (err error) {
+	if len(args) != 1 || args[0] != "recompute" {
+		return fmt.Errorf("rank: expected recompute")
+	}
+	cfg, err := kotori.LoadConfig(configPath)
+	if err != nil {
+		return
+	}
+	db, err := kotori.OpenDatabase(cfg)
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	err = kotori.Migrate(db)
+	if err != nil {
+		return
+	}
+	count, err := kotori.RecomputeRanks(db, cfg.RANK)
+	if err != nil {
+		return
+	}
+	fmt.Printf("%d ranks changed\n", count)
+	return
+}
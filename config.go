@@ -1,9 +1,218 @@
 package kotori
 
+import (
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
 var GlobCfg = Config{}
 
 type Config struct {
-	PORT         int64    `toml:"port"`
-	ADMIN        []Admin  `toml:"admin"`
-	ALLOW_ORIGIN []string `toml:"allow_origin"`
+	PORT         int64            `toml:"port"`
+	DATABASE     string           `toml:"database"`
+	ADMIN        []Admin          `toml:"admin"`
+	ALLOW_ORIGIN []string         `toml:"allow_origin"`
+	FEED         FeedConfig       `toml:"feed"`
+	COMMENT      CommentConfig    `toml:"comment"`
+	MODERATION   ModerationConfig `toml:"moderation"`
+	RANK         RankConfig       `toml:"rank"`
+	AVATAR       AvatarConfig     `toml:"avatar"`
+	MAIL         MailConfig       `toml:"mail"`
+	SPAM         SpamConfig       `toml:"spam"`
+	RATE_LIMIT   RateLimitConfig  `toml:"rate_limit"`
+	SESSION      SessionConfig    `toml:"session"`
+	SECRET       string           `toml:"secret"`
+}
+
+// FeedConfig describes the site in the RSS, Atom and JSON feeds. The URL
+// templates point to pages of the front-end; {slug}, {id} and
+// {comment_zone_id} are replaced with the values of the item.
+type FeedConfig struct {
+	TITLE            string `toml:"title"`
+	LINK             string `toml:"link"`
+	DESCRIPTION      string `toml:"description"`
+	POST_URL         string `toml:"post_url"`
+	COMMENT_ZONE_URL string `toml:"comment_zone_url"`
+	FULL_CONTENT     bool   `toml:"full_content"`
+}
+
+// CommentConfig sets how many comments are listed at once: PAGE_SIZE unless
+// the client asks for up to MAX_LIMIT. The threads returned by /v2/thread
+// hold MAX_DEPTH levels of replies, and MAX_REPLIES replies to each comment.
+// Visitors may react to comments with the emoji of REACTIONS, none if empty.
+// Commenters may edit or delete their comments for EDIT_MINUTES, never if 0.
+// Removed comments are deleted for good after RETENTION_DAYS, never if 0.
+type CommentConfig struct {
+	PAGE_SIZE      int      `toml:"page_size"`
+	MAX_LIMIT      int      `toml:"max_limit"`
+	MAX_DEPTH      int      `toml:"max_depth"`
+	MAX_REPLIES    int      `toml:"max_replies"`
+	REACTIONS      []string `toml:"reactions"`
+	EDIT_MINUTES   int      `toml:"edit_minutes"`
+	RETENTION_DAYS int      `toml:"retention_days"`
+}
+
+// ModerationConfig holds new comments for review when ENABLED, except those
+// by users with an approved comment already (APPROVE_KNOWN_USERS) or with a
+// Rank of at least APPROVE_RANK, when it is positive.
+type ModerationConfig struct {
+	ENABLED             bool  `toml:"enabled"`
+	APPROVE_KNOWN_USERS bool  `toml:"approve_known_users"`
+	APPROVE_RANK        int64 `toml:"approve_rank"`
+}
+
+// RankConfig sets how users earn their Rank: APPROVED_COMMENT for each of
+// their approved comments, minus SPAM_COMMENT for each marked as spam. Admins
+// may grant bonuses or penalties of up to MAX_GRANT, with no limit if 0.
+type RankConfig struct {
+	APPROVED_COMMENT int64 `toml:"approved_comment"`
+	SPAM_COMMENT     int64 `toml:"spam_comment"`
+	MAX_GRANT        int64 `toml:"max_grant"`
+}
+
+// AvatarConfig tells how visitors get the avatar of a commenter, whose email
+// is never shown to them. HASH is md5 or sha256; URL is an optional template
+// in which {hash} is replaced with the hash, such as
+// https://www.gravatar.com/avatar/{hash}?d=identicon.
+type AvatarConfig struct {
+	HASH string `toml:"hash"`
+	URL  string `toml:"url"`
+}
+
+// MailConfig sets up email notifications. BASE_URL is the public address of
+// this server, used in unsubscribe links; NOTIFY lists the addresses told
+// about every new comment. The templates are optional paths to text/template
+// files defining "subject" and "body".
+type MailConfig struct {
+	ENABLED        bool     `toml:"enabled"`
+	SMTP_ADDR      string   `toml:"smtp_addr"`
+	USERNAME       string   `toml:"username"`
+	PASSWORD       string   `toml:"password"`
+	FROM           string   `toml:"from"`
+	NOTIFY         []string `toml:"notify"`
+	BASE_URL       string   `toml:"base_url"`
+	REPLY_TEMPLATE string   `toml:"reply_template"`
+	ADMIN_TEMPLATE string   `toml:"admin_template"`
+	RETRIES        int      `toml:"retries"`
+}
+
+// SpamConfig tunes the spam filter. Comments scoring HOLD_SCORE or more are
+// held for moderation, SPAM_SCORE or more are marked as spam. HONEYPOT names
+// a form field hidden from humans; DUPLICATE_HOURS is how long a content is
+// remembered by the duplicate detector.
+type SpamConfig struct {
+	ENABLED         bool     `toml:"enabled"`
+	HOLD_SCORE      float64  `toml:"hold_score"`
+	SPAM_SCORE      float64  `toml:"spam_score"`
+	MAX_LINKS       int      `toml:"max_links"`
+	KEYWORDS        []string `toml:"keywords"`
+	HONEYPOT        string   `toml:"honeypot"`
+	DUPLICATE_HOURS int      `toml:"duplicate_hours"`
+}
+
+// RateLimitConfig throttles requests. STORE is memory or sqlite, the latter
+// keeping limits across restarts. TRUST_PROXY takes the client address from
+// the last entry of X-Forwarded-For, the one appended by the proxy in front of
+// kotori.
+type RateLimitConfig struct {
+	ENABLED     bool            `toml:"enabled"`
+	STORE       string          `toml:"store"`
+	TRUST_PROXY bool            `toml:"trust_proxy"`
+	RULES       []RateLimitRule `toml:"rule"`
+}
+
+// RateLimitRule allows BURST requests at once to the route METHOD PATH, then
+// PER_MINUTE requests a minute, for every value of KEY: ip, email or session.
+type RateLimitRule struct {
+	METHOD     string  `toml:"method"`
+	PATH       string  `toml:"path"`
+	KEY        string  `toml:"key"`
+	PER_MINUTE float64 `toml:"per_minute"`
+	BURST      int     `toml:"burst"`
+}
+
+// SessionConfig chooses where admin sessions are kept: in memory, as files in
+// the directory PATH, or in the database. LIFETIME is in seconds. SAME_SITE
+// is lax, strict, none or empty to leave the attribute out; SECURE cookies
+// are only sent over HTTPS.
+type SessionConfig struct {
+	PROVIDER  string `toml:"provider"`
+	PATH      string `toml:"path"`
+	LIFETIME  int64  `toml:"lifetime"`
+	SECURE    bool   `toml:"secure"`
+	HTTP_ONLY bool   `toml:"http_only"`
+	SAME_SITE string `toml:"same_site"`
+}
+
+// DefaultConfig returns the configuration used for any key missing from config.toml.
+func DefaultConfig() Config {
+	return Config{
+		PORT:         2332,
+		DATABASE:     "core.db",
+		ALLOW_ORIGIN: []string{"*"},
+		FEED: FeedConfig{
+			TITLE:        "kotori",
+			FULL_CONTENT: true,
+		},
+		COMMENT: CommentConfig{
+			PAGE_SIZE:      commentPageSize,
+			MAX_LIMIT:      50,
+			MAX_DEPTH:      3,
+			MAX_REPLIES:    5,
+			REACTIONS:      []string{"👍", "❤️", "😄", "🎉", "😕", "👀"},
+			EDIT_MINUTES:   15,
+			RETENTION_DAYS: 30,
+		},
+		MODERATION: ModerationConfig{
+			APPROVE_KNOWN_USERS: true,
+		},
+		RANK: RankConfig{
+			APPROVED_COMMENT: 50,
+			SPAM_COMMENT:     50,
+		},
+		AVATAR: AvatarConfig{
+			HASH: AvatarHashMD5,
+		},
+		SPAM: SpamConfig{
+			ENABLED:         true,
+			HOLD_SCORE:      0.5,
+			SPAM_SCORE:      0.9,
+			MAX_LINKS:       2,
+			DUPLICATE_HOURS: 24,
+		},
+		RATE_LIMIT: RateLimitConfig{
+			ENABLED: true,
+			STORE:   RateLimitStoreMemory,
+			RULES: []RateLimitRule{
+				{METHOD: "POST", PATH: "/v2/comment", KEY: RateLimitKeyIP, PER_MINUTE: 2, BURST: 5},
+				{METHOD: "POST", PATH: "/v2/comment", KEY: RateLimitKeyEmail, PER_MINUTE: 1, BURST: 3},
+				{METHOD: "POST", PATH: "/v2/auth", KEY: RateLimitKeyIP, PER_MINUTE: 1, BURST: 5},
+				{METHOD: "PUT", PATH: "/v2/comment/:id/vote", KEY: RateLimitKeyIP, PER_MINUTE: 10, BURST: 20},
+				{METHOD: "POST", PATH: "/v2/comment/:id/reaction", KEY: RateLimitKeyIP, PER_MINUTE: 10, BURST: 20},
+			},
+		},
+		SESSION: SessionConfig{
+			PROVIDER:  SessionProviderMemory,
+			PATH:      "sessions",
+			LIFETIME:  3600,
+			HTTP_ONLY: true,
+		},
+		MAIL: MailConfig{
+			SMTP_ADDR: "localhost:25",
+			RETRIES:   5,
+		},
+	}
+}
+
+func LoadConfig(path string) (cfg Config, err error) {
+	cfg = DefaultConfig()
+	_, err = toml.DecodeFile(path, &cfg)
+	if err == nil && (cfg.COMMENT.PAGE_SIZE < 1 || cfg.COMMENT.MAX_LIMIT < cfg.COMMENT.PAGE_SIZE) {
+		err = errors.New("comment page_size must be positive and not above max_limit")
+	}
+	if err != nil {
+		err = errors.Wrap(err, "LoadConfig")
+		return
+	}
+	return
 }
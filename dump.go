@@ -0,0 +1,195 @@
+package kotori
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Dump is the portable JSON representation of a kotori database used by the
+// import and export commands.
+type Dump struct {
+	Indexes          []Index           `json:"indexes"`
+	Users            []User            `json:"users"`
+	CommentZones     []CommentZone     `json:"comment_zones"`
+	Comments         []Comment         `json:"comments"`
+	Posts            []Post            `json:"posts"`
+	PostSlugs        []PostSlug        `json:"post_slugs"`
+	PostRevisions    []PostRevision    `json:"post_revisions"`
+	Tags             []Tag             `json:"tags"`
+	Categories       []Category        `json:"categories"`
+	PostTags         []PostTag         `json:"post_tags"`
+	PostCategories   []PostCategory    `json:"post_categories"`
+	SpamScores       []SpamScore       `json:"spam_scores"`
+	SpamTokens       []SpamToken       `json:"spam_tokens"`
+	CommentVotes     []CommentVote     `json:"comment_votes"`
+	CommentReactions []CommentReaction `json:"comment_reactions"`
+	CommentRevisions []CommentRevision `json:"comment_revisions"`
+	RankEvents       []RankEvent       `json:"rank_events"`
+}
+
+// PostTag is a row of the post_tags join table.
+type PostTag struct {
+	PostID uint `json:"post_id"`
+	TagID  uint `json:"tag_id"`
+}
+
+// PostCategory is a row of the post_categories join table.
+type PostCategory struct {
+	PostID     uint `json:"post_id"`
+	CategoryID uint `json:"category_id"`
+}
+
+func ExportDump(db *gorm.DB, w io.Writer) (err error) {
+	var dump Dump
+	err = db.Order("id asc").Find(&dump.Indexes).Error
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.Users).Error
+	}
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.CommentZones).Error
+	}
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.Comments).Error
+	}
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.Posts).Error
+	}
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.PostSlugs).Error
+	}
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.PostRevisions).Error
+	}
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.Tags).Error
+	}
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.Categories).Error
+	}
+	if err == nil {
+		err = db.Raw("SELECT post_id, tag_id FROM post_tags").Scan(&dump.PostTags).Error
+	}
+	if err == nil {
+		err = db.Raw("SELECT post_id, category_id FROM post_categories").Scan(&dump.PostCategories).Error
+	}
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.SpamScores).Error
+	}
+	if err == nil {
+		err = db.Order("token asc").Find(&dump.SpamTokens).Error
+	}
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.CommentVotes).Error
+	}
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.CommentReactions).Error
+	}
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.CommentRevisions).Error
+	}
+	if err == nil {
+		err = db.Order("id asc").Find(&dump.RankEvents).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "ExportDump")
+		return
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(dump)
+	if err != nil {
+		err = errors.Wrap(err, "ExportDump")
+		return
+	}
+	return
+}
+
+// ImportDump inserts every record of the dump read from r, keeping their ids.
+// Nothing is written if any record fails to insert.
+func ImportDump(db *gorm.DB, r io.Reader) (err error) {
+	var dump Dump
+	err = json.NewDecoder(r).Decode(&dump)
+	if err != nil {
+		err = errors.Wrap(err, "ImportDump")
+		return
+	}
+	tx := db.Begin().Set("gorm:save_associations", false)
+	for i := 0; err == nil && i < len(dump.Indexes); i++ {
+		err = tx.Create(&dump.Indexes[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.Users); i++ {
+		err = tx.Create(&dump.Users[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.CommentZones); i++ {
+		err = tx.Create(&dump.CommentZones[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.Comments); i++ {
+		err = tx.Create(&dump.Comments[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.Posts); i++ {
+		err = tx.Create(&dump.Posts[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.PostSlugs); i++ {
+		err = tx.Create(&dump.PostSlugs[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.PostRevisions); i++ {
+		err = tx.Create(&dump.PostRevisions[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.Tags); i++ {
+		err = tx.Create(&dump.Tags[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.Categories); i++ {
+		err = tx.Create(&dump.Categories[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.PostTags); i++ {
+		row := dump.PostTags[i]
+		err = tx.Exec("INSERT INTO post_tags (post_id, tag_id) VALUES (?, ?)", row.PostID, row.TagID).Error
+	}
+	for i := 0; err == nil && i < len(dump.PostCategories); i++ {
+		row := dump.PostCategories[i]
+		err = tx.Exec("INSERT INTO post_categories (post_id, category_id) VALUES (?, ?)", row.PostID, row.CategoryID).Error
+	}
+	for i := 0; err == nil && i < len(dump.SpamScores); i++ {
+		err = tx.Create(&dump.SpamScores[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.SpamTokens); i++ {
+		err = tx.Create(&dump.SpamTokens[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.CommentVotes); i++ {
+		err = tx.Create(&dump.CommentVotes[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.CommentReactions); i++ {
+		err = tx.Create(&dump.CommentReactions[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.CommentRevisions); i++ {
+		err = tx.Create(&dump.CommentRevisions[i]).Error
+	}
+	for i := 0; err == nil && i < len(dump.RankEvents); i++ {
+		err = tx.Create(&dump.RankEvents[i]).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "ImportDump")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		err = errors.Wrap(err, "ImportDump")
+		return
+	}
+	return
+}
+
+// BackupDatabase writes a consistent copy of the SQLite database to path,
+// which must not exist yet. It is safe to call while the server is running.
+func BackupDatabase(db *gorm.DB, path string) (err error) {
+	err = db.Exec("VACUUM INTO ?", path).Error
+	if err != nil {
+		err = errors.Wrap(err, "BackupDatabase")
+		return
+	}
+	return
+}
@@ -0,0 +1,116 @@
+package kotori
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// CommentRevision is the content of a comment before an edit by its author.
+type CommentRevision struct {
+	ID        uint      `gorm:"AUTO_INCREMENT" json:"id"`
+	CommentID uint      `gorm:"not null;index" json:"comment_id"`
+	Content   string    `gorm:"type:text" json:"content"`
+	Format    string    `json:"format"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CommentEditToken returns a token letting the author of comment edit or
+// delete it until expiresAt, window after it was created. The token is the
+// expiry time and its signature, so nothing is stored.
+func CommentEditToken(comment Comment, window time.Duration) (token string, expiresAt time.Time) {
+	expiresAt = comment.CreatedAt.Add(window).Truncate(time.Second)
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	token = expires + "." + sign("comment-edit", strconv.FormatUint(uint64(comment.ID), 10)+":"+expires)
+	return
+}
+
+// VerifyCommentEditToken reports whether token is an unexpired edit token of
+// the comment id.
+func VerifyCommentEditToken(id uint, token string) bool {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return false
+	}
+	return verifySignature("comment-edit", strconv.FormatUint(uint64(id), 10)+":"+parts[0], parts[1])
+}
+
+// UpdateComment replaces the content and the format of the comment
+// comment.ID, keeping the previous ones as a CommentRevision, and marks it
+// edited, unless its zone is locked. The spam scores of comment replace the
+// stored ones, and its Status, if set, the stored one, changing the Rank of
+// its user according to rules.
+func UpdateComment(db *gorm.DB, comment Comment, rules RankConfig) (comment_new Comment, err error) {
+	tx := db.Begin()
+	var old Comment
+	err = tx.Where("id = ? AND removed_at IS NULL", comment.ID).First(&old).Error
+	if err == nil {
+		err = checkCommentZoneUnlocked(tx, old.CommentZoneID)
+	}
+	if err == nil {
+		err = tx.Create(&CommentRevision{CommentID: old.ID, Content: old.Content, Format: old.Format}).Error
+	}
+	if err == nil {
+		if comment.Format == "" {
+			comment.Format = old.Format
+		}
+		now := time.Now()
+		fields := map[string]interface{}{
+			"content":      comment.Content,
+			"format":       comment.Format,
+			"content_html": RenderComment(comment.Format, comment.Content),
+			"spam_score":   comment.SpamScore,
+			"edited_at":    &now,
+		}
+		if comment.Status != "" {
+			fields["status"] = comment.Status
+		}
+		previous := old
+		err = tx.Model(&old).UpdateColumns(fields).Error
+		if err == nil {
+			err = adjustCommentRank(tx, rules, previous, old)
+		}
+	}
+	if err == nil {
+		err = tx.Delete(SpamScore{}, "comment_id = ?", comment.ID).Error
+	}
+	for i := 0; err == nil && i < len(comment.SpamScores); i++ {
+		comment.SpamScores[i].CommentID = comment.ID
+		err = tx.Create(&comment.SpamScores[i]).Error
+	}
+	if err == nil {
+		err = updateSearchIndex(tx, SearchTypeComment, comment.ID, "", comment.Content)
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "UpdateComment")
+		return
+	}
+	err = tx.Commit().Error
+	if err == nil {
+		comment_new, err = FindComment(db, comment.ID)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "UpdateComment")
+		return
+	}
+	return
+}
+
+// FindCommentRevisions lists the previous contents of a comment, newest
+// first.
+func FindCommentRevisions(db *gorm.DB, commentID uint) (revisions []CommentRevision, err error) {
+	err = db.Where("comment_id = ?", commentID).Order("id desc").Find(&revisions).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindCommentRevisions")
+		return
+	}
+	return
+}
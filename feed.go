@@ -0,0 +1,153 @@
+package kotori
+
+import (
+	"html"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/feeds"
+	"github.com/jinzhu/gorm"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/pkg/errors"
+)
+
+const (
+	FeedRSS  = "rss"
+	FeedAtom = "atom"
+	FeedJSON = "json"
+)
+
+var feedContentTypes = map[string]string{
+	FeedRSS:  "application/rss+xml; charset=utf-8",
+	FeedAtom: "application/atom+xml; charset=utf-8",
+	FeedJSON: "application/feed+json; charset=utf-8",
+}
+
+// excerptLength is the number of characters kept from posts and comments when
+// feeds carry excerpts instead of full content.
+const excerptLength = 200
+
+var excerptPolicy = bluemonday.StrictPolicy()
+
+// feedURL fills a URL template from FeedConfig.
+func feedURL(template string, values map[string]string) string {
+	for key, value := range values {
+		template = strings.Replace(template, "{"+key+"}", value, -1)
+	}
+	return template
+}
+
+// feedContent returns the HTML shown for an item, or an excerpt of its text.
+func feedContent(contentHTML string, content string, full bool) string {
+	if contentHTML == "" {
+		contentHTML = html.EscapeString(content)
+	}
+	if full {
+		return contentHTML
+	}
+	text := strings.Join(strings.Fields(html.UnescapeString(excerptPolicy.Sanitize(contentHTML))), " ")
+	if utf8.RuneCountInString(text) > excerptLength {
+		runes := []rune(text)
+		text = string(runes[:excerptLength]) + "…"
+	}
+	return html.EscapeString(text)
+}
+
+// PostFeed builds a feed of the latest published posts. Updated is the time
+// the newest of them changed, for use as Last-Modified.
+func PostFeed(db *gorm.DB, cfg FeedConfig, full bool) (feed *feeds.Feed, err error) {
+	posts, err := FindPosts(db, PostFilter{Status: PostStatusPublished}, 0)
+	if err != nil {
+		err = errors.Wrap(err, "PostFeed")
+		return
+	}
+	feed = &feeds.Feed{
+		Title:       cfg.TITLE,
+		Link:        &feeds.Link{Href: cfg.LINK},
+		Description: cfg.DESCRIPTION,
+		Id:          cfg.LINK,
+	}
+	for _, post := range posts {
+		link := feedURL(cfg.POST_URL, map[string]string{"slug": post.Slug, "id": strconv.FormatUint(uint64(post.ID), 10)})
+		created := post.CreatedAt
+		if post.PublishedAt != nil {
+			created = *post.PublishedAt
+		}
+		item := &feeds.Item{
+			Title:       post.Title,
+			Link:        &feeds.Link{Href: link},
+			Id:          link,
+			Created:     created,
+			Updated:     post.UpdatedAt,
+			Description: feedContent(post.ContentHTML, post.Content, false),
+		}
+		if post.Author != nil {
+			item.Author = &feeds.Author{Name: post.Author.Name}
+		}
+		if full {
+			item.Content = feedContent(post.ContentHTML, post.Content, true)
+		}
+		if item.Id == "" {
+			item.Id = "post:" + strconv.FormatUint(uint64(post.ID), 10)
+		}
+		feed.Add(item)
+		if post.UpdatedAt.After(feed.Updated) {
+			feed.Updated = post.UpdatedAt
+		}
+	}
+	return
+}
+
+// CommentFeed builds a feed of the latest comments and replies in a comment zone.
+func CommentFeed(db *gorm.DB, cfg FeedConfig, commentZoneID uint, full bool) (feed *feeds.Feed, err error) {
+	comments, err := FindRecentComments(db, commentZoneID, 20)
+	if err != nil {
+		err = errors.Wrap(err, "CommentFeed")
+		return
+	}
+	zone := strconv.FormatUint(uint64(commentZoneID), 10)
+	link := feedURL(cfg.COMMENT_ZONE_URL, map[string]string{"comment_zone_id": zone})
+	feed = &feeds.Feed{
+		Title:       "Comments - " + cfg.TITLE,
+		Link:        &feeds.Link{Href: link},
+		Description: cfg.DESCRIPTION,
+		Id:          link,
+	}
+	for _, comment := range comments {
+		id := strconv.FormatUint(uint64(comment.ID), 10)
+		item := &feeds.Item{
+			Title:       comment.User.Name,
+			Link:        &feeds.Link{Href: link},
+			Author:      &feeds.Author{Name: comment.User.Name},
+			Id:          "comment:" + zone + ":" + id,
+			Created:     comment.CreatedAt,
+			Updated:     comment.UpdatedAt,
+			Description: feedContent(comment.ContentHTML, comment.Content, full),
+		}
+		feed.Add(item)
+		if comment.UpdatedAt.After(feed.Updated) {
+			feed.Updated = comment.UpdatedAt
+		}
+	}
+	return
+}
+
+// RenderFeed serializes feed in the given format, one of FeedRSS, FeedAtom and FeedJSON.
+func RenderFeed(feed *feeds.Feed, format string) (body string, err error) {
+	switch format {
+	case FeedRSS:
+		body, err = feed.ToRss()
+	case FeedAtom:
+		body, err = feed.ToAtom()
+	case FeedJSON:
+		body, err = feed.ToJSON()
+	default:
+		err = errors.New("unknown feed format " + format)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "RenderFeed")
+		return
+	}
+	return
+}
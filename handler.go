@@ -1,9 +1,14 @@
 package kotori
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"github.com/gorilla/feeds"
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
 	"github.com/yanzay/log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
@@ -23,10 +28,82 @@ func respondJson(w http.ResponseWriter, data map[string]interface{}, httpStatusC
 	return
 }
 
-func checkAdmin(w http.ResponseWriter, req *http.Request) (result bool) {
+// authenticate returns the admin account the request is logged in with, or
+// the API token it carries, without responding to the client or starting a
+// session for anonymous visitors. Both are nil when the request carries
+// neither, or an invalid token.
+func authenticate(w http.ResponseWriter, req *http.Request) (admin *Admin, token *APIToken) {
+	if secret, ok := bearerToken(req); ok {
+		t, err := FindAPITokenBySecret(db, secret)
+		if err != nil {
+			if !strings.Contains(err.Error(), "record not found") {
+				log.Error(err)
+			}
+			return
+		}
+		token = &t
+		return
+	}
+	if _, err := req.Cookie(sessionCookieName); err != nil {
+		return
+	}
 	sess, _ := globalSessions.SessionStart(w, req)
 	defer sess.SessionRelease(w)
-	if priv := sess.Get("privilege"); priv == nil || priv.(string) != "admin" {
+	username, _ := sess.Get("username").(string)
+	if username == "" || sess.Get("privilege") != "admin" {
+		return
+	}
+	a, err := FindAdminByUsername(db, username)
+	if err != nil {
+		if !strings.Contains(err.Error(), "record not found") {
+			log.Error(err)
+		}
+		return
+	}
+	admin = &a
+	if err := TouchAdminSession(db, sess.SessionID()); err != nil {
+		log.Error(err)
+	}
+	return
+}
+
+// isAdmin reports whether the request is logged in with an admin account,
+// whatever its role.
+func isAdmin(w http.ResponseWriter, req *http.Request) bool {
+	admin, _ := authenticate(w, req)
+	return admin != nil
+}
+
+// can reports whether the admin account or the API token of the request is
+// granted permission, without responding to the client.
+func can(w http.ResponseWriter, req *http.Request, permission string) bool {
+	admin, token := authenticate(w, req)
+	return admin != nil && admin.Can(permission) || token != nil && token.Can(permission)
+}
+
+// authorName returns the name of the admin account or the API token returned
+// by authenticate, if any. Clients using an API token are named after it.
+func authorName(admin *Admin, token *APIToken) string {
+	if admin != nil {
+		return admin.Username
+	}
+	if token != nil {
+		return "token:" + token.Name
+	}
+	return ""
+}
+
+// checkPermission is can, responding to the client when the request is
+// anonymous or not granted permission.
+func checkPermission(w http.ResponseWriter, req *http.Request, permission string) (result bool) {
+	admin, token := authenticate(w, req)
+	return authorize(w, admin, token, permission)
+}
+
+// authorize is checkPermission for the admin account and the API token already
+// returned by authenticate, for handlers that need them afterwards.
+func authorize(w http.ResponseWriter, admin *Admin, token *APIToken, permission string) (result bool) {
+	if admin == nil && token == nil {
 		res := map[string]interface{}{
 			"code":   http.StatusUnauthorized,
 			"result": false,
@@ -36,6 +113,48 @@ func checkAdmin(w http.ResponseWriter, req *http.Request) (result bool) {
 		result = false
 		return
 	}
+	if !(admin != nil && admin.Can(permission) || token != nil && token.Can(permission)) {
+		res := map[string]interface{}{
+			"code":   http.StatusForbidden,
+			"result": false,
+			"msg":    "Permission denied: " + permission,
+		}
+		respondJson(w, res, http.StatusForbidden)
+		result = false
+		return
+	}
+	result = true
+	return
+}
+
+// checkPostPermission is authorize for changing the post id, which requires
+// PermissionPostEditOthers unless the request is by its author. Invalid and
+// unknown ids are left for the handler to report.
+func checkPostPermission(w http.ResponseWriter, admin *Admin, token *APIToken, id string) (result bool) {
+	if !authorize(w, admin, token, PermissionPostWrite) {
+		result = false
+		return
+	}
+	if token != nil || admin.Can(PermissionPostEditOthers) {
+		result = true
+		return
+	}
+	postID64, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		result = true
+		return
+	}
+	post, err := FindPost(db, uint(postID64))
+	if err == nil && post.AuthorID != admin.ID {
+		res := map[string]interface{}{
+			"code":   http.StatusForbidden,
+			"result": false,
+			"msg":    "Permission denied: " + PermissionPostEditOthers,
+		}
+		respondJson(w, res, http.StatusForbidden)
+		result = false
+		return
+	}
 	result = true
 	return
 }
@@ -105,59 +224,174 @@ func ListComment(w http.ResponseWriter, req *http.Request, ps httprouter.Params)
 		}
 		return
 	}
-	var fatherID uint
-	if len(req.Form["father_id"]) > 1 {
+	query := CommentQuery{CommentZoneID: commentZoneID}
+	if msg := parseCommentQuery(req, &query); msg != "" {
 		res := map[string]interface{}{
 			"code":   http.StatusBadRequest,
 			"result": false,
-			"msg":    "Invalid father id.",
+			"msg":    msg,
 		}
 		respondJson(w, res, http.StatusBadRequest)
 		return
-	} else if len(req.Form["father_id"]) == 1 {
-		fatherID64, err := strconv.ParseUint(req.Form["father_id"][0], 10, 32)
-		if err != nil {
-			log.Error(err)
+	}
+	comments, next, err := FindCommentPage(db, query)
+	if err != nil {
+		log.Error(err)
+		if errors.Cause(err) == ErrInvalidCursor {
 			res := map[string]interface{}{
 				"code":   http.StatusBadRequest,
 				"result": false,
-				"msg":    "Error occurred parsing father id.",
+				"msg":    "Invalid cursor.",
 			}
 			respondJson(w, res, http.StatusBadRequest)
 			return
 		}
-		fatherID = uint(fatherID64)
-	} else {
-		fatherID = 0
-	}
-	var offsetID uint
-	if len(req.Form["offset_id"]) > 1 {
 		res := map[string]interface{}{
-			"code":   http.StatusBadRequest,
+			"code":   http.StatusInternalServerError,
 			"result": false,
-			"msg":    "Invalid offset id.",
+			"msg":    "Error occurred querying comments.",
 		}
-		respondJson(w, res, http.StatusBadRequest)
+		respondJson(w, res, http.StatusInternalServerError)
 		return
+	}
+	var data interface{} = comments
+	if !can(w, req, PermissionCommentModerate) {
+		data = PublicComments(comments, GlobCfg.AVATAR)
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   data,
+		"cnt":    count,
+	}
+	if next != "" {
+		res["next_cursor"] = next
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// parseCommentQuery reads the father_id, sort, limit and cursor of a comment
+// listing into query, and returns what is wrong with them if anything.
+// Top-level comments are listed newest first and replies oldest first by
+// default. An offset_id stands for the cursor of the comments after it.
+func parseCommentQuery(req *http.Request, query *CommentQuery) (msg string) {
+	if len(req.Form["father_id"]) > 1 {
+		return "Invalid father id."
+	} else if len(req.Form["father_id"]) == 1 {
+		fatherID64, err := strconv.ParseUint(req.Form["father_id"][0], 10, 32)
+		if err != nil {
+			return "Error occurred parsing father id."
+		}
+		query.FatherID = uint(fatherID64)
+	}
+	query.Sort = CommentSortNewest
+	if query.FatherID != 0 {
+		query.Sort = CommentSortOldest
+	}
+	if len(req.Form["sort"]) > 1 {
+		return "Invalid sort."
+	} else if len(req.Form["sort"]) == 1 {
+		if !ValidCommentSort(req.Form["sort"][0]) {
+			return "Invalid sort."
+		}
+		query.Sort = req.Form["sort"][0]
+	}
+	query.Limit = GlobCfg.COMMENT.PAGE_SIZE
+	if len(req.Form["limit"]) > 1 {
+		return "Invalid limit."
+	} else if len(req.Form["limit"]) == 1 {
+		limit, err := strconv.Atoi(req.Form["limit"][0])
+		if err != nil || limit < 1 {
+			return "Invalid limit."
+		}
+		query.Limit = limit
+	}
+	if query.Limit > GlobCfg.COMMENT.MAX_LIMIT {
+		query.Limit = GlobCfg.COMMENT.MAX_LIMIT
+	}
+	if len(req.Form["cursor"]) > 1 {
+		return "Invalid cursor."
+	} else if len(req.Form["cursor"]) == 1 {
+		query.Cursor = req.Form["cursor"][0]
+	} else if len(req.Form["offset_id"]) > 1 {
+		return "Invalid offset id."
 	} else if len(req.Form["offset_id"]) == 1 {
 		offsetID64, err := strconv.ParseUint(req.Form["offset_id"][0], 10, 32)
 		if err != nil {
-			log.Error(err)
+			return "Error occurred parsing offset id."
+		}
+		if offsetID64 != 0 {
+			query.Cursor = OffsetCursor(query.Sort, uint(offsetID64))
+		}
+	}
+	return
+}
+
+// ListThread lists a page of the comments replying to father_id, top-level
+// by default, with their replies nested down to depth levels and up to
+// replies under each comment, both bounded by the configuration.
+func ListThread(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	req.ParseForm()
+	if len(req.Form["comment_zone_id"]) != 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid comment zone.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	commentZoneID64, err := strconv.ParseUint(req.Form["comment_zone_id"][0], 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing comment zone id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	query := CommentQuery{CommentZoneID: uint(commentZoneID64)}
+	if msg := parseCommentQuery(req, &query); msg != "" {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    msg,
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	depth, replies := GlobCfg.COMMENT.MAX_DEPTH, GlobCfg.COMMENT.MAX_REPLIES
+	for key, value := range map[string]*int{"depth": &depth, "replies": &replies} {
+		if len(req.Form[key]) == 1 {
+			n, err := strconv.Atoi(req.Form[key][0])
+			if err != nil || n < 0 {
+				res := map[string]interface{}{
+					"code":   http.StatusBadRequest,
+					"result": false,
+					"msg":    "Invalid " + key + ".",
+				}
+				respondJson(w, res, http.StatusBadRequest)
+				return
+			}
+			if n < *value {
+				*value = n
+			}
+		}
+	}
+	threads, next, err := FindCommentThreadPage(db, query, depth, replies)
+	if err != nil {
+		log.Error(err)
+		if errors.Cause(err) == ErrInvalidCursor {
 			res := map[string]interface{}{
 				"code":   http.StatusBadRequest,
 				"result": false,
-				"msg":    "Error occurred parsing offset id.",
+				"msg":    "Invalid cursor.",
 			}
 			respondJson(w, res, http.StatusBadRequest)
 			return
 		}
-		offsetID = uint(offsetID64)
-	} else {
-		offsetID = 0
-	}
-	comments, err := FindComments(db, commentZoneID, fatherID, offsetID)
-	if err != nil {
-		log.Error(err)
 		res := map[string]interface{}{
 			"code":   http.StatusInternalServerError,
 			"result": false,
@@ -166,11 +400,17 @@ func ListComment(w http.ResponseWriter, req *http.Request, ps httprouter.Params)
 		respondJson(w, res, http.StatusInternalServerError)
 		return
 	}
+	var data interface{} = threads
+	if !can(w, req, PermissionCommentModerate) {
+		data = PublicCommentThreads(threads, GlobCfg.AVATAR)
+	}
 	res := map[string]interface{}{
 		"code":   http.StatusOK,
 		"result": true,
-		"data":   comments,
-		"cnt":    count,
+		"data":   data,
+	}
+	if next != "" {
+		res["next_cursor"] = next
 	}
 	respondJson(w, res, http.StatusOK)
 }
@@ -199,6 +439,35 @@ func CreateComment(w http.ResponseWriter, req *http.Request, ps httprouter.Param
 		return
 	}
 	commentZoneID := uint(commentZoneID64)
+	zone, err := FindCommentZone(db, commentZoneID)
+	if err != nil {
+		log.Error(err)
+		if strings.Contains(err.Error(), "record not found") {
+			res := map[string]interface{}{
+				"code":   http.StatusNotFound,
+				"result": false,
+				"msg":    "Comment zone not found.",
+			}
+			respondJson(w, res, http.StatusNotFound)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying comment zone.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	if !zone.Open {
+		res := map[string]interface{}{
+			"code":   http.StatusForbidden,
+			"result": false,
+			"msg":    "Comment zone is closed.",
+		}
+		respondJson(w, res, http.StatusForbidden)
+		return
+	}
 	comment.CommentZoneID = commentZoneID
 	if len(req.Form["content"]) != 1 {
 		res := map[string]interface{}{
@@ -210,6 +479,18 @@ func CreateComment(w http.ResponseWriter, req *http.Request, ps httprouter.Param
 		return
 	}
 	comment.Content = req.Form["content"][0]
+	if len(req.Form["format"]) == 1 {
+		if !ValidFormat(req.Form["format"][0]) {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid content format.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		comment.Format = req.Form["format"][0]
+	}
 	if len(req.Form["name"]) != 1 {
 		res := map[string]interface{}{
 			"code":   http.StatusBadRequest,
@@ -294,7 +575,28 @@ func CreateComment(w http.ResponseWriter, req *http.Request, ps httprouter.Param
 	comment.FatherID = fatherID
 	comment.ReplyUserID = replyUserID
 	comment.Type = "Comment"
-	comment, err = StoreComment(db, comment)
+	admin := isAdmin(w, req)
+	if admin {
+		comment.Status = CommentStatusApproved
+	} else {
+		comment.SpamScore, comment.SpamScores, err = spamFilter.Check(db, comment, req.Form)
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusInternalServerError,
+				"result": false,
+				"msg":    "Error occurred checking comment for spam.",
+			}
+			respondJson(w, res, http.StatusInternalServerError)
+			return
+		}
+		if spamFilter != nil && comment.SpamScore >= GlobCfg.SPAM.SPAM_SCORE {
+			comment.Status = CommentStatusSpam
+		} else if spamFilter != nil && comment.SpamScore >= GlobCfg.SPAM.HOLD_SCORE {
+			comment.Status = CommentStatusPending
+		}
+	}
+	comment, err = StoreComment(db, comment, GlobCfg.MODERATION, GlobCfg.RANK)
 	if err != nil {
 		log.Error(err)
 		res := map[string]interface{}{
@@ -305,19 +607,34 @@ func CreateComment(w http.ResponseWriter, req *http.Request, ps httprouter.Param
 		respondJson(w, res, http.StatusInternalServerError)
 		return
 	}
+	if !admin && comment.Status != CommentStatusSpam {
+		notifier.NotifyAdmins(comment)
+	}
+	if comment.Status == CommentStatusApproved {
+		notifier.NotifyReply(db, comment)
+	}
+	if !admin && comment.Status != CommentStatusSpam {
+		setCommenterCookie(w, comment.User)
+	}
+	var data interface{} = comment
+	if !admin {
+		data = comment.Public(GlobCfg.AVATAR)
+	}
 	res := map[string]interface{}{
 		"code":   http.StatusOK,
 		"result": true,
-		"data":   comment,
+		"data":   data,
+	}
+	if GlobCfg.COMMENT.EDIT_MINUTES > 0 {
+		res["edit_token"], res["edit_expires_at"] = CommentEditToken(comment,
+			time.Duration(GlobCfg.COMMENT.EDIT_MINUTES)*time.Minute)
 	}
 	respondJson(w, res, http.StatusOK)
 }
 
-func DeleteComment(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	if !checkAdmin(w, req) {
-		return
-	}
-
+// EditComment replaces the content of a comment for the holder of its edit
+// token. The new content goes through the spam filter again.
+func EditComment(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	commentID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
 	if err != nil {
 		log.Error(err)
@@ -330,188 +647,2482 @@ func DeleteComment(w http.ResponseWriter, req *http.Request, ps httprouter.Param
 		return
 	}
 	commentID := uint(commentID64)
-	err = RemoveComment(db, commentID)
-	if err != nil {
-		log.Error(err)
+	req.ParseForm()
+	if len(req.Form["token"]) != 1 || !VerifyCommentEditToken(commentID, req.Form["token"][0]) {
 		res := map[string]interface{}{
-			"code":   http.StatusInternalServerError,
+			"code":   http.StatusForbidden,
 			"result": false,
-			"msg":    "Error occurred removing comment from database.",
+			"msg":    "Invalid or expired edit token.",
 		}
-		respondJson(w, res, http.StatusInternalServerError)
+		respondJson(w, res, http.StatusForbidden)
 		return
 	}
-	res := map[string]interface{}{
-		"code":   http.StatusOK,
-		"result": true,
+	if len(req.Form["content"]) != 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid comment content.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
 	}
-	respondJson(w, res, http.StatusOK)
-}
-
-func Login(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	sess, _ := globalSessions.SessionStart(w, req)
-	defer sess.SessionRelease(w)
-	if username := sess.Get("username"); username != nil {
+	comment, err := FindComment(db, commentID)
+	if err == nil && comment.RemovedAt != nil {
 		res := map[string]interface{}{
-			"code":   http.StatusOK,
+			"code":   http.StatusNotFound,
 			"result": false,
-			"msg":    "Already logged in as: " + username.(string),
+			"msg":    "Comment not found.",
 		}
-		respondJson(w, res, http.StatusOK)
-	} else {
-		req.ParseForm()
-		if len(req.Form["username"]) != 1 {
+		respondJson(w, res, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		if strings.Contains(err.Error(), "record not found") {
 			res := map[string]interface{}{
-				"code":   http.StatusBadRequest,
+				"code":   http.StatusNotFound,
 				"result": false,
-				"msg":    "Invalid username.",
+				"msg":    "Comment not found.",
 			}
-			respondJson(w, res, http.StatusBadRequest)
+			respondJson(w, res, http.StatusNotFound)
 			return
 		}
-		username = req.Form["username"][0]
-		if len(req.Form["password"]) != 1 {
-			res := map[string]interface{}{
-				"code":   http.StatusBadRequest,
-				"result": false,
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying comment.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	comment.Content = req.Form["content"][0]
+	if len(req.Form["format"]) == 1 {
+		if !ValidFormat(req.Form["format"][0]) {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid content format.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		comment.Format = req.Form["format"][0]
+	}
+	comment.SpamScore, comment.SpamScores, err = spamFilter.Check(db, comment, req.Form)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred checking comment for spam.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	// Edits can hold a comment back for moderation, but never release it.
+	comment.Status = ""
+	if spamFilter != nil && comment.SpamScore >= GlobCfg.SPAM.SPAM_SCORE {
+		comment.Status = CommentStatusSpam
+	} else if spamFilter != nil && comment.SpamScore >= GlobCfg.SPAM.HOLD_SCORE {
+		comment.Status = CommentStatusPending
+	}
+	comment, err = UpdateComment(db, comment, GlobCfg.RANK)
+	if err != nil {
+		log.Error(err)
+		if errors.Cause(err) == ErrCommentZoneLocked {
+			res := map[string]interface{}{
+				"code":   http.StatusForbidden,
+				"result": false,
+				"msg":    "Comment zone is locked.",
+			}
+			respondJson(w, res, http.StatusForbidden)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred updating comment.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   comment.Public(GlobCfg.AVATAR),
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// ListCommentRevision lists the contents a comment had before it was edited.
+func ListCommentRevision(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionCommentModerate) {
+		return
+	}
+
+	commentID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing comment id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	revisions, err := FindCommentRevisions(db, uint(commentID64))
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying comment revisions.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   revisions,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// DeleteComment leaves a tombstone in place of a comment, for moderators or
+// for the holder of its edit token. Moderators may remove the replies under
+// it as well with thread=true.
+func DeleteComment(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	commentID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing comment id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	commentID := uint(commentID64)
+	req.ParseForm()
+	thread := false
+	if len(req.Form["thread"]) == 1 {
+		thread, err = strconv.ParseBool(req.Form["thread"][0])
+		if err != nil {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid thread.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+	}
+	if len(req.Form["token"]) == 1 && !thread {
+		if !VerifyCommentEditToken(commentID, req.Form["token"][0]) {
+			res := map[string]interface{}{
+				"code":   http.StatusForbidden,
+				"result": false,
+				"msg":    "Invalid or expired edit token.",
+			}
+			respondJson(w, res, http.StatusForbidden)
+			return
+		}
+	} else if !checkPermission(w, req, PermissionCommentModerate) {
+		return
+	}
+	err = RemoveComment(db, commentID, thread, GlobCfg.RANK)
+	if err != nil {
+		log.Error(err)
+		if strings.Contains(err.Error(), "record not found") {
+			res := map[string]interface{}{
+				"code":   http.StatusNotFound,
+				"result": false,
+				"msg":    "Comment not found.",
+			}
+			respondJson(w, res, http.StatusNotFound)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred removing comment from database.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// RestoreComment brings back a removed comment, with the replies removed
+// along with it.
+func RestoreComment(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionCommentModerate) {
+		return
+	}
+
+	commentID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing comment id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	commentID := uint(commentID64)
+	err = RestoreRemovedComment(db, commentID, GlobCfg.RANK)
+	if err == nil {
+		var comment Comment
+		comment, err = FindComment(db, commentID)
+		if err == nil {
+			res := map[string]interface{}{
+				"code":   http.StatusOK,
+				"result": true,
+				"data":   comment,
+			}
+			respondJson(w, res, http.StatusOK)
+			return
+		}
+	}
+	log.Error(err)
+	if strings.Contains(err.Error(), "record not found") {
+		res := map[string]interface{}{
+			"code":   http.StatusNotFound,
+			"result": false,
+			"msg":    "Removed comment not found.",
+		}
+		respondJson(w, res, http.StatusNotFound)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusInternalServerError,
+		"result": false,
+		"msg":    "Error occurred restoring comment.",
+	}
+	respondJson(w, res, http.StatusInternalServerError)
+}
+
+// VoteComment records the vote of the visitor on a comment: value 1 for up,
+// -1 for down or 0 to withdraw it.
+func VoteComment(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	commentID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing comment id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	req.ParseForm()
+	if len(req.Form["value"]) != 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid vote.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	value, err := strconv.Atoi(req.Form["value"][0])
+	if err != nil || value < -1 || value > 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid vote.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	voter, err := voterKey(w, req)
+	if err == nil {
+		var comment Comment
+		comment, err = StoreCommentVote(db, uint(commentID64), voter, value)
+		if err == nil {
+			res := map[string]interface{}{
+				"code":   http.StatusOK,
+				"result": true,
+				"data":   comment.Public(GlobCfg.AVATAR),
+				"vote":   value,
+			}
+			respondJson(w, res, http.StatusOK)
+			return
+		}
+	}
+	respondReactionError(w, err)
+}
+
+// CreateReaction adds the reaction emoji of the visitor to a comment.
+func CreateReaction(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	reactToComment(w, req, ps, true)
+}
+
+// DeleteReaction withdraws the reaction emoji of the visitor from a comment.
+func DeleteReaction(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	reactToComment(w, req, ps, false)
+}
+
+// reactToComment adds the reaction of req to the comment of ps if add, or
+// withdraws it.
+func reactToComment(w http.ResponseWriter, req *http.Request, ps httprouter.Params, add bool) {
+	commentID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing comment id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	req.ParseForm()
+	if len(req.Form["emoji"]) != 1 || !ValidReaction(GlobCfg.COMMENT, req.Form["emoji"][0]) {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid emoji.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	voter, err := voterKey(w, req)
+	if err == nil {
+		var comment Comment
+		if add {
+			comment, err = StoreCommentReaction(db, uint(commentID64), voter, req.Form["emoji"][0])
+		} else {
+			comment, err = RemoveCommentReaction(db, uint(commentID64), voter, req.Form["emoji"][0])
+		}
+		if err == nil {
+			res := map[string]interface{}{
+				"code":   http.StatusOK,
+				"result": true,
+				"data":   comment.Public(GlobCfg.AVATAR),
+			}
+			respondJson(w, res, http.StatusOK)
+			return
+		}
+	}
+	respondReactionError(w, err)
+}
+
+func respondReactionError(w http.ResponseWriter, err error) {
+	log.Error(err)
+	if errors.Cause(err) == ErrCommentZoneLocked {
+		res := map[string]interface{}{
+			"code":   http.StatusForbidden,
+			"result": false,
+			"msg":    "Comment zone is locked.",
+		}
+		respondJson(w, res, http.StatusForbidden)
+		return
+	}
+	if strings.Contains(err.Error(), "record not found") {
+		res := map[string]interface{}{
+			"code":   http.StatusNotFound,
+			"result": false,
+			"msg":    "Comment not found.",
+		}
+		respondJson(w, res, http.StatusNotFound)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusInternalServerError,
+		"result": false,
+		"msg":    "Error occurred storing reaction to database.",
+	}
+	respondJson(w, res, http.StatusInternalServerError)
+}
+
+// parseCommentZone reads the comment zone asked for with comment_zone=true
+// when creating a post or an index, nil if none, and returns what is wrong
+// with it if anything.
+func parseCommentZone(req *http.Request) (zone *CommentZone, msg string) {
+	if len(req.Form["comment_zone"]) != 1 {
+		return
+	}
+	create, err := strconv.ParseBool(req.Form["comment_zone"][0])
+	if err != nil {
+		return nil, "Invalid comment zone."
+	}
+	if !create {
+		return
+	}
+	zone = &CommentZone{}
+	var closeAfterDays *int
+	zone.State, closeAfterDays, msg = parseCommentZoneSettings(req)
+	if closeAfterDays != nil {
+		zone.CloseAfterDays = *closeAfterDays
+	}
+	return
+}
+
+// parseCommentZoneSettings reads the state and the close_after_days of a
+// comment zone, empty and nil when missing, and returns what is wrong with
+// them if anything.
+func parseCommentZoneSettings(req *http.Request) (state string, closeAfterDays *int, msg string) {
+	if len(req.Form["state"]) > 1 {
+		return "", nil, "Invalid comment zone state."
+	} else if len(req.Form["state"]) == 1 {
+		state = req.Form["state"][0]
+		if !ValidCommentZoneState(state) {
+			return "", nil, "Invalid comment zone state."
+		}
+	}
+	if len(req.Form["close_after_days"]) > 1 {
+		return "", nil, "Invalid close after days."
+	} else if len(req.Form["close_after_days"]) == 1 {
+		days, err := strconv.Atoi(req.Form["close_after_days"][0])
+		if err != nil || days < 0 {
+			return "", nil, "Invalid close after days."
+		}
+		closeAfterDays = &days
+	}
+	return
+}
+
+func GetCommentZone(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	zoneID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing comment zone id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	zone, err := FindCommentZone(db, uint(zoneID64))
+	if err != nil {
+		log.Error(err)
+		if strings.Contains(err.Error(), "record not found") {
+			res := map[string]interface{}{
+				"code":   http.StatusNotFound,
+				"result": false,
+				"msg":    "Comment zone not found.",
+			}
+			respondJson(w, res, http.StatusNotFound)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying comment zone.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   zone,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// CreateCommentZone creates a comment zone for the post post_id, the index
+// index_id, or neither.
+func CreateCommentZone(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionCommentModerate) {
+		return
+	}
+
+	req.ParseForm()
+	var zone CommentZone
+	for key, id := range map[string]*uint{"post_id": &zone.PostID, "index_id": &zone.IndexID} {
+		if len(req.Form[key]) == 1 {
+			id64, err := strconv.ParseUint(req.Form[key][0], 10, 32)
+			if err != nil {
+				log.Error(err)
+				res := map[string]interface{}{
+					"code":   http.StatusBadRequest,
+					"result": false,
+					"msg":    "Error occurred parsing " + strings.Replace(key, "_", " ", 1) + ".",
+				}
+				respondJson(w, res, http.StatusBadRequest)
+				return
+			}
+			*id = uint(id64)
+		}
+	}
+	if zone.PostID != 0 && zone.IndexID != 0 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "A comment zone belongs to a post or an index, not both.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	var closeAfterDays *int
+	var msg string
+	zone.State, closeAfterDays, msg = parseCommentZoneSettings(req)
+	if msg != "" {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    msg,
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	if closeAfterDays != nil {
+		zone.CloseAfterDays = *closeAfterDays
+	}
+	zone, err := StoreCommentZone(db, zone)
+	if err != nil {
+		log.Error(err)
+		if errors.Cause(err) == ErrCommentZoneTaken {
+			res := map[string]interface{}{
+				"code":   http.StatusConflict,
+				"result": false,
+				"msg":    "The post or index already has a comment zone.",
+			}
+			respondJson(w, res, http.StatusConflict)
+			return
+		}
+		if strings.Contains(err.Error(), "record not found") {
+			res := map[string]interface{}{
+				"code":   http.StatusNotFound,
+				"result": false,
+				"msg":    "Post or index not found.",
+			}
+			respondJson(w, res, http.StatusNotFound)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred storing comment zone to database.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   zone,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// EditCommentZone opens, closes or locks a comment zone, or changes how many
+// days after publication it closes by itself.
+func EditCommentZone(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionCommentModerate) {
+		return
+	}
+
+	zoneID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing comment zone id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	req.ParseForm()
+	state, closeAfterDays, msg := parseCommentZoneSettings(req)
+	if msg != "" {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    msg,
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	zone, err := UpdateCommentZone(db, uint(zoneID64), state, closeAfterDays)
+	if err != nil {
+		log.Error(err)
+		if strings.Contains(err.Error(), "record not found") {
+			res := map[string]interface{}{
+				"code":   http.StatusNotFound,
+				"result": false,
+				"msg":    "Comment zone not found.",
+			}
+			respondJson(w, res, http.StatusNotFound)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred updating comment zone.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   zone,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// ListModerationQueue lists the comments in a moderation state, pending by
+// default, across all comment zones.
+func ListModerationQueue(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionCommentModerate) {
+		return
+	}
+
+	req.ParseForm()
+	status := CommentStatusPending
+	if len(req.Form["status"]) > 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid comment status.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	} else if len(req.Form["status"]) == 1 {
+		status = req.Form["status"][0]
+		if !validCommentStatus(status) {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid comment status.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+	}
+	var offsetID uint
+	if len(req.Form["offset_id"]) > 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid offset id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	} else if len(req.Form["offset_id"]) == 1 {
+		offsetID64, err := strconv.ParseUint(req.Form["offset_id"][0], 10, 32)
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Error occurred parsing offset id.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		offsetID = uint(offsetID64)
+	}
+	count, err := CountCommentsByStatus(db, status)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred counting comments.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	comments, err := FindCommentsByStatus(db, status, offsetID)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying comments.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   comments,
+		"cnt":    count,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// ModerateComment sets the status of every comment listed in id, so that the
+// queue can be approved or rejected in bulk.
+func ModerateComment(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionCommentModerate) {
+		return
+	}
+
+	req.ParseForm()
+	if len(req.Form["status"]) != 1 || !validCommentStatus(req.Form["status"][0]) {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid comment status.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	status := req.Form["status"][0]
+	if len(req.Form["id"]) == 0 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid comment id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	var ids []uint
+	for _, id := range req.Form["id"] {
+		id64, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Error occurred parsing comment id.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, uint(id64))
+	}
+	moderated, err := ModerateComments(db, ids, status, GlobCfg.RANK)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred moderating comments.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	if status == CommentStatusApproved {
+		for _, comment := range moderated {
+			notifier.NotifyReply(db, comment)
+		}
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"cnt":    len(moderated),
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func validCommentStatus(status string) bool {
+	switch status {
+	case CommentStatusPending, CommentStatusApproved, CommentStatusSpam, CommentStatusRejected:
+		return true
+	}
+	return false
+}
+
+// unsubscribePage asks for confirmation before unsubscribing, so that link
+// scanners and mail prefetchers following the link change nothing. The form
+// posts back to the link itself.
+const unsubscribePage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unsubscribe</title></head>
+<body>
+<form method="post">
+<p>Stop receiving emails about comments?</p>
+<button type="submit">Unsubscribe</button>
+</form>
+</body>
+</html>
+`
+
+// unsubscribeUser returns the user an unsubscribe link was signed for, or
+// responds with an error and returns false.
+func unsubscribeUser(w http.ResponseWriter, req *http.Request) (user User, ok bool) {
+	if len(req.Form["user_id"]) != 1 || len(req.Form["token"]) != 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid unsubscribe link.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	userID64, err := strconv.ParseUint(req.Form["user_id"][0], 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing user id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	user, err = FindUser(db, uint(userID64))
+	if err != nil || !verifySignature("unsubscribe", req.Form["user_id"][0]+":"+user.Email, req.Form["token"][0]) {
+		res := map[string]interface{}{
+			"code":   http.StatusForbidden,
+			"result": false,
+			"msg":    "Invalid unsubscribe link.",
+		}
+		respondJson(w, res, http.StatusForbidden)
+		return
+	}
+	ok = true
+	return
+}
+
+// ConfirmUnsubscribe serves the page an unsubscribe link opens in a browser.
+// Mail clients supporting List-Unsubscribe-Post skip it and post directly.
+func ConfirmUnsubscribe(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	req.ParseForm()
+	if _, ok := unsubscribeUser(w, req); !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(unsubscribePage))
+}
+
+// Unsubscribe opts a user out of reply notifications. It serves both the form
+// of unsubscribePage and RFC 8058 one-click POST requests.
+func Unsubscribe(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	req.ParseForm()
+	user, ok := unsubscribeUser(w, req)
+	if !ok {
+		return
+	}
+	err := UpdateUserSetEmailOptOut(db, user.ID, true)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred updating user.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"msg":    "You will no longer receive emails.",
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func Login(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	sess, _ := globalSessions.SessionStart(w, req)
+	defer sess.SessionRelease(w)
+	if username := sess.Get("username"); username != nil {
+		res := map[string]interface{}{
+			"code":   http.StatusOK,
+			"result": false,
+			"msg":    "Already logged in as: " + username.(string),
+		}
+		respondJson(w, res, http.StatusOK)
+	} else {
+		req.ParseForm()
+		if len(req.Form["username"]) != 1 {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid username.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		username = req.Form["username"][0]
+		if len(req.Form["password"]) != 1 {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid password.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		password := req.Form["password"][0]
+		ipKey := "ip:" + clientIP(req, GlobCfg.RATE_LIMIT.TRUST_PROXY)
+		usernameKey := "username:" + username.(string)
+		if wait := loginAttempts.Locked(time.Now(), ipKey); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			res := map[string]interface{}{
+				"code":   http.StatusTooManyRequests,
+				"result": false,
+				"msg":    "Too many failed logins, please retry later.",
+			}
+			respondJson(w, res, http.StatusTooManyRequests)
+			return
+		}
+		time.Sleep(loginAttempts.Delay(time.Now(), usernameKey))
+		admin, ok, err := AuthenticateAdmin(db, username.(string), password)
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusInternalServerError,
+				"result": false,
+				"msg":    "Error occurred checking password.",
+			}
+			respondJson(w, res, http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			// The failures of the username stay, as they may come from others.
+			loginAttempts.Succeed(ipKey)
+			sess.Set("username", admin.Username)
+			sess.Set("privilege", "admin")
+			err := StoreAdminSession(db, AdminSession{
+				SID:       sess.SessionID(),
+				Username:  admin.Username,
+				IP:        clientIP(req, GlobCfg.RATE_LIMIT.TRUST_PROXY),
+				UserAgent: req.UserAgent(),
+			})
+			if err != nil {
+				log.Error(err)
+			}
+			res := map[string]interface{}{
+				"code":   http.StatusOK,
+				"result": true,
+				"msg":    "Successfully logged in as: " + admin.Username,
+				"role":   admin.Role,
+			}
+			respondJson(w, res, http.StatusOK)
+			return
+		}
+		loginAttempts.Fail(time.Now(), ipKey, usernameKey)
+		res := map[string]interface{}{
+			"code":   http.StatusOK,
+			"result": false,
+			"msg":    "No such user or password mismatch.",
+		}
+		respondJson(w, res, http.StatusOK)
+		return
+	}
+}
+
+func Logout(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	sess, _ := globalSessions.SessionStart(w, req)
+	defer sess.SessionRelease(w)
+	sess.Delete("username")
+	sess.Delete("privilege")
+	if err := RemoveAdminSessionBySID(db, sess.SessionID()); err != nil {
+		log.Error(err)
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"msg":    "Successfully logged out.",
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// ListSession lists the sessions admins are logged in with.
+func ListSession(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionAdminManage) {
+		return
+	}
+
+	sessions, err := FindAdminSessions(db, globalSessions)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying sessions.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	sess, _ := globalSessions.SessionStart(w, req)
+	defer sess.SessionRelease(w)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].SID == sess.SessionID()
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   sessions,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// RevokeSession logs out an admin session.
+func RevokeSession(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionAdminManage) {
+		return
+	}
+
+	sessionID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing session id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	err = RemoveAdminSession(db, globalSessions, uint(sessionID64))
+	if err != nil {
+		log.Error(err)
+		if strings.Contains(err.Error(), "record not found") {
+			res := map[string]interface{}{
+				"code":   http.StatusNotFound,
+				"result": false,
+				"msg":    "Session not found.",
+			}
+			respondJson(w, res, http.StatusNotFound)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred revoking session.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// ListToken lists the API tokens, without their secrets.
+func ListToken(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionAdminManage) {
+		return
+	}
+
+	tokens, err := FindAPITokens(db)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying tokens.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   tokens,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// CreateToken creates an API token with a name, one or more scope values and
+// an optional expires_in in days. The secret is only returned here.
+func CreateToken(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionAdminManage) {
+		return
+	}
+
+	req.ParseForm()
+	if len(req.Form["name"]) != 1 || strings.TrimSpace(req.Form["name"][0]) == "" {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid name.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	token := APIToken{Name: strings.TrimSpace(req.Form["name"][0])}
+	if len(req.Form["scope"]) == 0 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "At least one scope is required.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Form["scope"] {
+		if !validTokenScope(scope) {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid scope: " + scope,
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		if !token.HasScope(scope) {
+			token.ScopeList = append(token.ScopeList, scope)
+		}
+	}
+	if len(req.Form["expires_in"]) == 1 {
+		days, err := strconv.ParseUint(req.Form["expires_in"][0], 10, 32)
+		if err != nil || days == 0 {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid expires_in.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		expiresAt := time.Now().AddDate(0, 0, int(days))
+		token.ExpiresAt = &expiresAt
+	}
+	secret, err := StoreAPIToken(db, &token)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred creating token.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   token,
+		"token":  secret,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// DeleteToken revokes an API token.
+func DeleteToken(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionAdminManage) {
+		return
+	}
+
+	tokenID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing token id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	err = RemoveAPIToken(db, uint(tokenID64))
+	if err != nil {
+		log.Error(err)
+		if strings.Contains(err.Error(), "record not found") {
+			res := map[string]interface{}{
+				"code":   http.StatusNotFound,
+				"result": false,
+				"msg":    "Token not found.",
+			}
+			respondJson(w, res, http.StatusNotFound)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred revoking token.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func ListAdmin(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionAdminManage) {
+		return
+	}
+
+	admins, err := FindAdmins(db)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying admins.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   admins,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// CreateAdmin adds an admin account with a username, a password and a role.
+func CreateAdmin(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionAdminManage) {
+		return
+	}
+
+	req.ParseForm()
+	if len(req.Form["username"]) != 1 || strings.TrimSpace(req.Form["username"][0]) == "" {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid username.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	if len(req.Form["password"]) != 1 || req.Form["password"][0] == "" {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid password.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	if len(req.Form["role"]) != 1 || !ValidRole(req.Form["role"][0]) {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid role.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	admin := Admin{Username: strings.TrimSpace(req.Form["username"][0]), Role: req.Form["role"][0]}
+	if len(req.Form["name"]) == 1 {
+		admin.Name = req.Form["name"][0]
+	}
+	if len(req.Form["email"]) == 1 {
+		admin.Email = req.Form["email"][0]
+	}
+	hash, err := HashPassword(req.Form["password"][0])
+	if err == nil {
+		admin.Password = hash
+		admin, err = StoreAdmin(db, admin)
+	}
+	if err != nil {
+		log.Error(err)
+		if errors.Cause(err) == ErrNameTaken {
+			res := map[string]interface{}{
+				"code":   http.StatusConflict,
+				"result": false,
+				"msg":    "Username already in use.",
+			}
+			respondJson(w, res, http.StatusConflict)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred storing admin.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   admin,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// EditAdmin changes the role, the password, the name or the email of an admin
+// account. Admins may change their own account but its role without
+// PermissionAdminManage.
+func EditAdmin(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	req.ParseForm()
+	adminID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing admin id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	admin := Admin{ID: uint(adminID64)}
+	if self, token := authenticate(w, req); self == nil || self.ID != admin.ID || len(req.Form["role"]) != 0 {
+		if !authorize(w, self, token, PermissionAdminManage) {
+			return
+		}
+	}
+
+	if len(req.Form["role"]) == 1 {
+		if !ValidRole(req.Form["role"][0]) {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid role.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		admin.Role = req.Form["role"][0]
+	}
+	if len(req.Form["name"]) == 1 {
+		admin.Name = req.Form["name"][0]
+	}
+	if len(req.Form["email"]) == 1 {
+		admin.Email = req.Form["email"][0]
+	}
+	if len(req.Form["password"]) == 1 {
+		if req.Form["password"][0] == "" {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
 				"msg":    "Invalid password.",
 			}
 			respondJson(w, res, http.StatusBadRequest)
 			return
 		}
-		password := req.Form["password"][0]
-		for _, admin := range GlobCfg.ADMIN {
-			if admin.Username == username && admin.Password == password {
-				sess.Set("username", username)
-				sess.Set("privilege", "admin")
-				res := map[string]interface{}{
-					"code":   http.StatusOK,
-					"result": true,
-					"msg":    "Successfully logged in as: " + username.(string),
-				}
-				respondJson(w, res, http.StatusOK)
-				return
+		hash, err := HashPassword(req.Form["password"][0])
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusInternalServerError,
+				"result": false,
+				"msg":    "Error occurred hashing password.",
+			}
+			respondJson(w, res, http.StatusInternalServerError)
+			return
+		}
+		admin.Password = hash
+	}
+	admin, err = UpdateAdmin(db, admin)
+	if err != nil {
+		log.Error(err)
+		if errors.Cause(err) == ErrLastOwner {
+			res := map[string]interface{}{
+				"code":   http.StatusConflict,
+				"result": false,
+				"msg":    "The last owner cannot be demoted.",
+			}
+			respondJson(w, res, http.StatusConflict)
+			return
+		}
+		if strings.Contains(err.Error(), "record not found") {
+			res := map[string]interface{}{
+				"code":   http.StatusNotFound,
+				"result": false,
+				"msg":    "Admin not found.",
+			}
+			respondJson(w, res, http.StatusNotFound)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred storing admin.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   admin,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// DeleteAdmin removes an admin account and logs out its sessions.
+func DeleteAdmin(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionAdminManage) {
+		return
+	}
+
+	adminID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing admin id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	err = RemoveAdmin(db, globalSessions, uint(adminID64))
+	if err != nil {
+		log.Error(err)
+		if errors.Cause(err) == ErrLastOwner {
+			res := map[string]interface{}{
+				"code":   http.StatusConflict,
+				"result": false,
+				"msg":    "The last owner cannot be removed.",
+			}
+			respondJson(w, res, http.StatusConflict)
+			return
+		}
+		if strings.Contains(err.Error(), "record not found") {
+			res := map[string]interface{}{
+				"code":   http.StatusNotFound,
+				"result": false,
+				"msg":    "Admin not found.",
+			}
+			respondJson(w, res, http.StatusNotFound)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred removing admin.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func EditUserSetHonor(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionUserWrite) {
+		return
+	}
+
+	req.ParseForm()
+	userID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing user id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	userID := uint(userID64)
+	if len(req.Form["honor"]) != 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid honor.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	honor := req.Form["honor"][0]
+	user, err := UpdateUserSetHonor(db, userID, honor)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred storing user to database: " + err.Error(),
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   user,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func ListUserRankEvent(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionUserWrite) {
+		return
+	}
+
+	req.ParseForm()
+	userID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing user id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	var offsetID uint
+	if len(req.Form["offset_id"]) > 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid offset id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	} else if len(req.Form["offset_id"]) == 1 {
+		offsetID64, err := strconv.ParseUint(req.Form["offset_id"][0], 10, 32)
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Error occurred parsing offset id.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		offsetID = uint(offsetID64)
+	}
+	events, err := FindRankEvents(db, uint(userID64), offsetID)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying rank events.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   events,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+// GrantUserRank adds a bonus, or a penalty if negative, to the rank of a user.
+func GrantUserRank(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	admin, token := authenticate(w, req)
+	if !authorize(w, admin, token, PermissionUserWrite) {
+		return
+	}
+
+	req.ParseForm()
+	userID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing user id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	if len(req.Form["delta"]) != 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid delta.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	delta, err := strconv.ParseInt(req.Form["delta"][0], 10, 64)
+	if err != nil || delta == 0 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid delta.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	if len(req.Form["note"]) > 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid note.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	var note string
+	if len(req.Form["note"]) == 1 {
+		note = req.Form["note"][0]
+	}
+	var adminID uint
+	if admin != nil {
+		adminID = admin.ID
+	}
+	user, err := GrantRank(db, GlobCfg.RANK, uint(userID64), adminID, delta, note)
+	if err != nil {
+		log.Error(err)
+		status, msg := http.StatusInternalServerError, "Error occurred storing rank event."
+		if errors.Cause(err) == ErrRankGrantTooLarge {
+			status, msg = http.StatusBadRequest, "Delta exceeds the maximum grant."
+		} else if strings.Contains(err.Error(), "record not found") {
+			status, msg = http.StatusNotFound, "User not found."
+		}
+		res := map[string]interface{}{
+			"code":   status,
+			"result": false,
+			"msg":    msg,
+		}
+		respondJson(w, res, status)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   user,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func ListIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	req.ParseForm()
+	if len(req.Form["class"]) != 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid index class.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	class := req.Form["class"][0]
+	var offsetID uint
+	if len(req.Form["offset_id"]) > 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid offset id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	} else if len(req.Form["offset_id"]) == 1 {
+		offsetID64, err := strconv.ParseUint(req.Form["offset_id"][0], 10, 32)
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Error occurred parsing offset id.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		offsetID = uint(offsetID64)
+	} else {
+		offsetID = 0
+	}
+	var order = "asc"
+	if len(req.Form["order"]) == 1 && req.Form["order"][0] != "asc" {
+		order = "desc"
+	}
+	indexes, err := FindIndexes(db, class, order, offsetID)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying indexes.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	for i := range indexes {
+		SetAvatars(GlobCfg.AVATAR, indexes[i].Author, indexes[i].UpdatedBy)
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   indexes,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func GetIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var index Index
+	var err error
+	if req.Header.Get("X-Query-By") == "Title" {
+		indexTitle := ps.ByName("id")
+		index, err = FindIndexByTitle(db, indexTitle)
+	} else {
+		indexID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Error occurred parsing index id.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		indexID := uint(indexID64)
+		index, err = FindIndex(db, indexID)
+	}
+	if err != nil {
+		log.Error(err)
+		if strings.Contains(err.Error(), "record not found") {
+			res := map[string]interface{}{
+				"code":   http.StatusNotFound,
+				"result": false,
+				"msg":    "Index not found.",
+			}
+			respondJson(w, res, http.StatusNotFound)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying index from database.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	SetAvatars(GlobCfg.AVATAR, index.Author, index.UpdatedBy)
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   index,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func CreateIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	admin, token := authenticate(w, req)
+	if !authorize(w, admin, token, PermissionIndexWrite) {
+		return
+	}
+
+	req.ParseForm()
+	var index Index
+	if len(req.Form["class"]) != 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid index class.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	index.Class = req.Form["class"][0]
+	if len(req.Form["attr"]) == 1 {
+		index.Attr = req.Form["attr"][0]
+	}
+	if len(req.Form["title"]) == 1 {
+		index.Title = req.Form["title"][0]
+	}
+	var msg string
+	if index.CommentZone, msg = parseCommentZone(req); msg != "" {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    msg,
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	if admin != nil {
+		index.AuthorID = admin.ID
+		index.UpdatedByID = admin.ID
+	}
+	index, err := StoreIndex(db, index)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred storing index to database.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   index,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func EditIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	admin, token := authenticate(w, req)
+	if !authorize(w, admin, token, PermissionIndexWrite) {
+		return
+	}
+
+	req.ParseForm()
+	var index Index
+	indexID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing index id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	indexID := uint(indexID64)
+	index.ID = indexID
+	if len(req.Form["class"]) != 0 {
+		res := map[string]interface{}{
+			"code":   http.StatusForbidden,
+			"result": false,
+			"msg":    "Class could not be changed.",
+		}
+		respondJson(w, res, http.StatusForbidden)
+		return
+	}
+	if len(req.Form["attr"]) == 1 {
+		index.Attr = req.Form["attr"][0]
+	}
+	if len(req.Form["title"]) == 1 {
+		index.Title = req.Form["title"][0]
+	}
+	if admin != nil {
+		index.UpdatedByID = admin.ID
+	}
+	index, err = UpdateIndex(db, index)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred storing index to database.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   index,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func DeleteIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionIndexWrite) {
+		return
+	}
+
+	indexID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing index id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	indexID := uint(indexID64)
+	err = RemoveIndex(db, indexID)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred removing index from database.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func ListPost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	req.ParseForm()
+	var offsetID uint
+	if len(req.Form["offset_id"]) > 1 {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid offset id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	} else if len(req.Form["offset_id"]) == 1 {
+		offsetID64, err := strconv.ParseUint(req.Form["offset_id"][0], 10, 32)
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Error occurred parsing offset id.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		offsetID = uint(offsetID64)
+	} else {
+		offsetID = 0
+	}
+	filter := PostFilter{Status: PostStatusPublished}
+	if can(w, req, PermissionPostWrite) {
+		filter.Status = ""
+		if len(req.Form["status"]) == 1 {
+			filter.Status = req.Form["status"][0]
+		}
+	}
+	if len(req.Form["tag"]) == 1 {
+		filter.Tag = req.Form["tag"][0]
+	}
+	if len(req.Form["category"]) == 1 {
+		filter.Category = req.Form["category"][0]
+	}
+	if len(req.Form["author"]) == 1 {
+		authorID64, err := strconv.ParseUint(req.Form["author"][0], 10, 32)
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Error occurred parsing author id.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		filter.AuthorID = uint(authorID64)
+	}
+	posts, err := FindPosts(db, filter, offsetID)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying posts.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	for i := range posts {
+		SetAvatars(GlobCfg.AVATAR, posts[i].Author, posts[i].UpdatedBy)
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   posts,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func GetPost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	var post Post
+	var moved bool
+	var err error
+	if req.Header.Get("X-Query-By") == "Slug" {
+		post, moved, err = FindPostBySlug(db, ps.ByName("id"))
+	} else {
+		var postID64 uint64
+		postID64, err = strconv.ParseUint(ps.ByName("id"), 10, 32)
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Error occurred parsing post id.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		postID := uint(postID64)
+		post, err = FindPost(db, postID)
+	}
+	if err != nil {
+		log.Error(err)
+		if strings.Contains(err.Error(), "record not found") {
+			res := map[string]interface{}{
+				"code":   http.StatusNotFound,
+				"result": false,
+				"msg":    "Post not found.",
+			}
+			respondJson(w, res, http.StatusNotFound)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying post from database.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	if post.Status != PostStatusPublished && !can(w, req, PermissionPostWrite) {
+		res := map[string]interface{}{
+			"code":   http.StatusNotFound,
+			"result": false,
+			"msg":    "Post not found.",
+		}
+		respondJson(w, res, http.StatusNotFound)
+		return
+	}
+	SetAvatars(GlobCfg.AVATAR, post.Author, post.UpdatedBy)
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   post,
+	}
+	if moved {
+		res["canonical_slug"] = post.Slug
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func CreatePost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	admin, token := authenticate(w, req)
+	if !authorize(w, admin, token, PermissionPostWrite) {
+		return
+	}
+
+	req.ParseForm()
+	var post Post
+	if len(req.Form["content"]) == 1 {
+		post.Content = req.Form["content"][0]
+	}
+	if len(req.Form["title"]) == 1 {
+		post.Title = req.Form["title"][0]
+	}
+	post.Status = PostStatusPublished
+	if len(req.Form["slug"]) == 1 {
+		post.Slug = MakeSlug(req.Form["slug"][0])
+		if post.Slug == "" {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid post slug.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+	}
+	if len(req.Form["format"]) == 1 {
+		if !ValidFormat(req.Form["format"][0]) {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid content format.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		post.Format = req.Form["format"][0]
+	}
+	parsePostTerms(req, &post)
+	if msg := parsePostStatus(req, &post); msg != "" {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    msg,
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	var msg string
+	if post.CommentZone, msg = parseCommentZone(req); msg != "" {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    msg,
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	if admin != nil {
+		post.AuthorID = admin.ID
+		post.UpdatedByID = admin.ID
+	}
+	post, err := StorePost(db, post, authorName(admin, token))
+	if err != nil {
+		log.Error(err)
+		if errors.Cause(err) == ErrSlugTaken {
+			res := map[string]interface{}{
+				"code":   http.StatusConflict,
+				"result": false,
+				"msg":    "Slug already in use.",
+			}
+			respondJson(w, res, http.StatusConflict)
+			return
+		}
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred storing post to database.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	if post.Status == PostStatusScheduled {
+		wakeScheduler()
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   post,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func EditPost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	admin, token := authenticate(w, req)
+	if !checkPostPermission(w, admin, token, ps.ByName("id")) {
+		return
+	}
+
+	req.ParseForm()
+	var post Post
+	postID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing index id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	postID := uint(postID64)
+	post.ID = postID
+	if len(req.Form["content"]) == 1 {
+		post.Content = req.Form["content"][0]
+	}
+	if len(req.Form["title"]) == 1 {
+		post.Title = req.Form["title"][0]
+	}
+	if len(req.Form["slug"]) == 1 {
+		post.Slug = MakeSlug(req.Form["slug"][0])
+		if post.Slug == "" {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid post slug.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+	}
+	if len(req.Form["format"]) == 1 {
+		if !ValidFormat(req.Form["format"][0]) {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid content format.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		post.Format = req.Form["format"][0]
+	}
+	parsePostTerms(req, &post)
+	if msg := parsePostStatus(req, &post); msg != "" {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    msg,
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	if admin != nil {
+		post.UpdatedByID = admin.ID
+	}
+	post, err = UpdatePost(db, post, authorName(admin, token))
+	if err != nil {
+		log.Error(err)
+		if errors.Cause(err) == ErrSlugTaken {
+			res := map[string]interface{}{
+				"code":   http.StatusConflict,
+				"result": false,
+				"msg":    "Slug already in use.",
 			}
+			respondJson(w, res, http.StatusConflict)
+			return
 		}
 		res := map[string]interface{}{
-			"code":   http.StatusOK,
+			"code":   http.StatusInternalServerError,
 			"result": false,
-			"msg":    "No such user or password mismatch.",
+			"msg":    "Error occurred storing post to database.",
 		}
-		respondJson(w, res, http.StatusOK)
+		respondJson(w, res, http.StatusInternalServerError)
 		return
 	}
-	log.Info(GlobCfg.ADMIN)
+	if post.Status == PostStatusScheduled {
+		wakeScheduler()
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   post,
+	}
+	respondJson(w, res, http.StatusOK)
 }
 
-func Logout(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	sess, _ := globalSessions.SessionStart(w, req)
-	defer sess.SessionRelease(w)
-	sess.Delete("username")
-	sess.Delete("privilege")
+// parsePostStatus reads the optional status and published_at form values into
+// post. It returns a message describing the problem if they are invalid.
+func parsePostStatus(req *http.Request, post *Post) (msg string) {
+	if len(req.Form["status"]) > 1 {
+		return "Invalid post status."
+	} else if len(req.Form["status"]) == 1 {
+		switch status := req.Form["status"][0]; status {
+		case PostStatusDraft, PostStatusPublished, PostStatusScheduled, PostStatusPrivate:
+			post.Status = status
+		default:
+			return "Invalid post status."
+		}
+	}
+	if len(req.Form["published_at"]) > 1 {
+		return "Invalid publish time."
+	} else if len(req.Form["published_at"]) == 1 {
+		publishedAt, err := time.Parse(time.RFC3339, req.Form["published_at"][0])
+		if err != nil {
+			return "Error occurred parsing publish time."
+		}
+		post.PublishedAt = &publishedAt
+	}
+	if post.Status == PostStatusScheduled && post.PublishedAt == nil {
+		return "Scheduled posts require a publish time."
+	}
+	return
+}
+
+// parsePostTerms reads the tags and categories form values into post. Sending
+// a single empty value clears them; omitting them leaves them unchanged.
+func parsePostTerms(req *http.Request, post *Post) {
+	if names, ok := req.Form["tags"]; ok {
+		post.Tags = []Tag{}
+		for _, name := range names {
+			if name = strings.TrimSpace(name); name != "" {
+				post.Tags = append(post.Tags, Tag{Name: name})
+			}
+		}
+	}
+	if names, ok := req.Form["categories"]; ok {
+		post.Categories = []Category{}
+		for _, name := range names {
+			if name = strings.TrimSpace(name); name != "" {
+				post.Categories = append(post.Categories, Category{Name: name})
+			}
+		}
+	}
+}
+
+func DeletePost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	admin, token := authenticate(w, req)
+	if !checkPostPermission(w, admin, token, ps.ByName("id")) {
+		return
+	}
+
+	postID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing index id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	postID := uint(postID64)
+	err = RemovePost(db, postID)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred removing post from database.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
 	res := map[string]interface{}{
 		"code":   http.StatusOK,
 		"result": true,
-		"msg":    "Successfully logged out.",
 	}
 	respondJson(w, res, http.StatusOK)
 }
 
-func EditUserSetHonor(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	if !checkAdmin(w, req) {
+func ListTag(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	tags, err := FindTags(db)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying tags.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   tags,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func EditTag(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionPostEditOthers) {
 		return
 	}
 
 	req.ParseForm()
-	userID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	var tag Tag
+	tagID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
 	if err != nil {
 		log.Error(err)
 		res := map[string]interface{}{
 			"code":   http.StatusBadRequest,
 			"result": false,
-			"msg":    "Error occurred parsing user id.",
+			"msg":    "Error occurred parsing tag id.",
 		}
 		respondJson(w, res, http.StatusBadRequest)
 		return
 	}
-	userID := uint(userID64)
-	if len(req.Form["honor"]) != 1 {
+	tag.ID = uint(tagID64)
+	if len(req.Form["name"]) != 1 || strings.TrimSpace(req.Form["name"][0]) == "" {
 		res := map[string]interface{}{
 			"code":   http.StatusBadRequest,
 			"result": false,
-			"msg":    "Invalid honor.",
+			"msg":    "Invalid tag name.",
 		}
 		respondJson(w, res, http.StatusBadRequest)
 		return
 	}
-	honor := req.Form["honor"][0]
-	user, err := UpdateUserSetHonor(db, userID, honor)
+	tag.Name = strings.TrimSpace(req.Form["name"][0])
+	tag, err = UpdateTag(db, tag)
 	if err != nil {
 		log.Error(err)
+		if errors.Cause(err) == ErrNameTaken {
+			res := map[string]interface{}{
+				"code":   http.StatusConflict,
+				"result": false,
+				"msg":    "Tag name already in use, merge the tags instead.",
+			}
+			respondJson(w, res, http.StatusConflict)
+			return
+		}
 		res := map[string]interface{}{
-			"code":   http.StatusBadRequest,
+			"code":   http.StatusInternalServerError,
 			"result": false,
-			"msg":    "Error occurred storing user to database: " + err.Error(),
+			"msg":    "Error occurred storing tag to database.",
 		}
-		respondJson(w, res, http.StatusBadRequest)
+		respondJson(w, res, http.StatusInternalServerError)
 		return
 	}
 	res := map[string]interface{}{
 		"code":   http.StatusOK,
 		"result": true,
-		"data":   user,
+		"data":   tag,
 	}
 	respondJson(w, res, http.StatusOK)
 }
 
-func ListIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+func MergeTagInto(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionPostEditOthers) {
+		return
+	}
+
 	req.ParseForm()
-	if len(req.Form["class"]) != 1 {
+	tagID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
 		res := map[string]interface{}{
 			"code":   http.StatusBadRequest,
 			"result": false,
-			"msg":    "Invalid index class.",
+			"msg":    "Error occurred parsing tag id.",
 		}
 		respondJson(w, res, http.StatusBadRequest)
 		return
 	}
-	class := req.Form["class"][0]
-	var offsetID uint
-	if len(req.Form["offset_id"]) > 1 {
+	tagID := uint(tagID64)
+	if len(req.Form["into"]) != 1 {
 		res := map[string]interface{}{
 			"code":   http.StatusBadRequest,
 			"result": false,
-			"msg":    "Invalid offset id.",
+			"msg":    "Invalid target tag.",
 		}
 		respondJson(w, res, http.StatusBadRequest)
 		return
-	} else if len(req.Form["offset_id"]) == 1 {
-		offsetID64, err := strconv.ParseUint(req.Form["offset_id"][0], 10, 32)
-		if err != nil {
-			log.Error(err)
+	}
+	intoID64, err := strconv.ParseUint(req.Form["into"][0], 10, 32)
+	if err != nil || uint(intoID64) == tagID {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid target tag.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	err = MergeTag(db, tagID, uint(intoID64))
+	if err != nil {
+		log.Error(err)
+		if strings.Contains(err.Error(), "record not found") {
 			res := map[string]interface{}{
-				"code":   http.StatusBadRequest,
+				"code":   http.StatusNotFound,
 				"result": false,
-				"msg":    "Error occurred parsing offset id.",
+				"msg":    "Target tag not found.",
 			}
-			respondJson(w, res, http.StatusBadRequest)
+			respondJson(w, res, http.StatusNotFound)
 			return
 		}
-		offsetID = uint(offsetID64)
-	} else {
-		offsetID = 0
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred merging tags.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
 	}
-	var order = "asc"
-	if len(req.Form["order"]) == 1 && req.Form["order"][0] != "asc" {
-		order = "desc"
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
 	}
-	indexes, err := FindIndexes(db, class, order, offsetID)
+	respondJson(w, res, http.StatusOK)
+}
+
+func DeleteTag(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionPostEditOthers) {
+		return
+	}
+
+	tagID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing tag id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	err = RemoveTag(db, uint(tagID64))
 	if err != nil {
 		log.Error(err)
 		res := map[string]interface{}{
 			"code":   http.StatusInternalServerError,
 			"result": false,
-			"msg":    "Error occurred querying indexes.",
+			"msg":    "Error occurred removing tag from database.",
 		}
 		respondJson(w, res, http.StatusInternalServerError)
 		return
@@ -519,47 +3130,75 @@ func ListIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	res := map[string]interface{}{
 		"code":   http.StatusOK,
 		"result": true,
-		"data":   indexes,
 	}
 	respondJson(w, res, http.StatusOK)
 }
 
-func GetIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	var index Index
-	var err error
-	if req.Header.Get("X-Query-By") == "Title" {
-		indexTitle := ps.ByName("id")
-		index, err = FindIndexByTitle(db, indexTitle)
-	} else {
-		indexID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
-		if err != nil {
-			log.Error(err)
-			res := map[string]interface{}{
-				"code":   http.StatusBadRequest,
-				"result": false,
-				"msg":    "Error occurred parsing index id.",
-			}
-			respondJson(w, res, http.StatusBadRequest)
-			return
+func ListCategory(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	categories, err := FindCategories(db)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusInternalServerError,
+			"result": false,
+			"msg":    "Error occurred querying categories.",
+		}
+		respondJson(w, res, http.StatusInternalServerError)
+		return
+	}
+	res := map[string]interface{}{
+		"code":   http.StatusOK,
+		"result": true,
+		"data":   categories,
+	}
+	respondJson(w, res, http.StatusOK)
+}
+
+func EditCategory(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionPostEditOthers) {
+		return
+	}
+
+	req.ParseForm()
+	var category Category
+	categoryID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing category id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	category.ID = uint(categoryID64)
+	if len(req.Form["name"]) != 1 || strings.TrimSpace(req.Form["name"][0]) == "" {
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Invalid category name.",
 		}
-		indexID := uint(indexID64)
-		index, err = FindIndex(db, indexID)
+		respondJson(w, res, http.StatusBadRequest)
+		return
 	}
+	category.Name = strings.TrimSpace(req.Form["name"][0])
+	category, err = UpdateCategory(db, category)
 	if err != nil {
 		log.Error(err)
-		if strings.Contains(err.Error(), "record not found") {
+		if errors.Cause(err) == ErrNameTaken {
 			res := map[string]interface{}{
-				"code":   http.StatusNotFound,
+				"code":   http.StatusConflict,
 				"result": false,
-				"msg":    "Index not found.",
+				"msg":    "Category name already in use.",
 			}
-			respondJson(w, res, http.StatusNotFound)
+			respondJson(w, res, http.StatusConflict)
 			return
 		}
 		res := map[string]interface{}{
 			"code":   http.StatusInternalServerError,
 			"result": false,
-			"msg":    "Error occurred querying index from database.",
+			"msg":    "Error occurred storing category to database.",
 		}
 		respondJson(w, res, http.StatusInternalServerError)
 		return
@@ -567,41 +3206,34 @@ func GetIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	res := map[string]interface{}{
 		"code":   http.StatusOK,
 		"result": true,
-		"data":   index,
+		"data":   category,
 	}
 	respondJson(w, res, http.StatusOK)
 }
 
-func CreateIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	if !checkAdmin(w, req) {
+func DeleteCategory(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	if !checkPermission(w, req, PermissionPostEditOthers) {
 		return
 	}
 
-	req.ParseForm()
-	var index Index
-	if len(req.Form["class"]) != 1 {
+	categoryID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
 		res := map[string]interface{}{
 			"code":   http.StatusBadRequest,
 			"result": false,
-			"msg":    "Invalid index class.",
+			"msg":    "Error occurred parsing category id.",
 		}
 		respondJson(w, res, http.StatusBadRequest)
 		return
 	}
-	index.Class = req.Form["class"][0]
-	if len(req.Form["attr"]) == 1 {
-		index.Attr = req.Form["attr"][0]
-	}
-	if len(req.Form["title"]) == 1 {
-		index.Title = req.Form["title"][0]
-	}
-	index, err := StoreIndex(db, index)
+	err = RemoveCategory(db, uint(categoryID64))
 	if err != nil {
 		log.Error(err)
 		res := map[string]interface{}{
 			"code":   http.StatusInternalServerError,
 			"result": false,
-			"msg":    "Error occurred storing index to database.",
+			"msg":    "Error occurred removing category from database.",
 		}
 		respondJson(w, res, http.StatusInternalServerError)
 		return
@@ -609,53 +3241,35 @@ func CreateIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params)
 	res := map[string]interface{}{
 		"code":   http.StatusOK,
 		"result": true,
-		"data":   index,
 	}
 	respondJson(w, res, http.StatusOK)
 }
 
-func EditIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	if !checkAdmin(w, req) {
+func ListPostRevision(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	admin, token := authenticate(w, req)
+	if !checkPostPermission(w, admin, token, ps.ByName("id")) {
 		return
 	}
 
-	req.ParseForm()
-	var index Index
-	indexID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	postID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
 	if err != nil {
 		log.Error(err)
 		res := map[string]interface{}{
 			"code":   http.StatusBadRequest,
 			"result": false,
-			"msg":    "Error occurred parsing index id.",
+			"msg":    "Error occurred parsing post id.",
 		}
 		respondJson(w, res, http.StatusBadRequest)
 		return
 	}
-	indexID := uint(indexID64)
-	index.ID = indexID
-	if len(req.Form["class"]) != 0 {
-		res := map[string]interface{}{
-			"code":   http.StatusForbidden,
-			"result": false,
-			"msg":    "Class could not be changed.",
-		}
-		respondJson(w, res, http.StatusForbidden)
-		return
-	}
-	if len(req.Form["attr"]) == 1 {
-		index.Attr = req.Form["attr"][0]
-	}
-	if len(req.Form["title"]) == 1 {
-		index.Title = req.Form["title"][0]
-	}
-	index, err = UpdateIndex(db, index)
+	postID := uint(postID64)
+	revisions, err := FindPostRevisions(db, postID)
 	if err != nil {
 		log.Error(err)
 		res := map[string]interface{}{
 			"code":   http.StatusInternalServerError,
 			"result": false,
-			"msg":    "Error occurred storing index to database.",
+			"msg":    "Error occurred querying revisions.",
 		}
 		respondJson(w, res, http.StatusInternalServerError)
 		return
@@ -663,35 +3277,57 @@ func EditIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	res := map[string]interface{}{
 		"code":   http.StatusOK,
 		"result": true,
-		"data":   index,
+		"data":   revisions,
 	}
 	respondJson(w, res, http.StatusOK)
 }
 
-func DeleteIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	if !checkAdmin(w, req) {
+func GetPostRevision(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	admin, token := authenticate(w, req)
+	if !checkPostPermission(w, admin, token, ps.ByName("id")) {
 		return
 	}
 
-	indexID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	postID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
 	if err != nil {
 		log.Error(err)
 		res := map[string]interface{}{
 			"code":   http.StatusBadRequest,
 			"result": false,
-			"msg":    "Error occurred parsing index id.",
+			"msg":    "Error occurred parsing post id.",
 		}
 		respondJson(w, res, http.StatusBadRequest)
 		return
 	}
-	indexID := uint(indexID64)
-	err = RemoveIndex(db, indexID)
+	postID := uint(postID64)
+	revisionID64, err := strconv.ParseUint(ps.ByName("rev"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing revision id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	revisionID := uint(revisionID64)
+	revision, err := FindPostRevision(db, postID, revisionID)
 	if err != nil {
 		log.Error(err)
+		if strings.Contains(err.Error(), "record not found") {
+			res := map[string]interface{}{
+				"code":   http.StatusNotFound,
+				"result": false,
+				"msg":    "Revision not found.",
+			}
+			respondJson(w, res, http.StatusNotFound)
+			return
+		}
 		res := map[string]interface{}{
 			"code":   http.StatusInternalServerError,
 			"result": false,
-			"msg":    "Error occurred removing index from database.",
+			"msg":    "Error occurred querying revision from database.",
 		}
 		respondJson(w, res, http.StatusInternalServerError)
 		return
@@ -699,44 +3335,80 @@ func DeleteIndex(w http.ResponseWriter, req *http.Request, ps httprouter.Params)
 	res := map[string]interface{}{
 		"code":   http.StatusOK,
 		"result": true,
+		"data":   revision,
 	}
 	respondJson(w, res, http.StatusOK)
 }
 
-func ListPost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+func DiffPost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	admin, token := authenticate(w, req)
+	if !checkPostPermission(w, admin, token, ps.ByName("id")) {
+		return
+	}
+
 	req.ParseForm()
-	var offsetID uint
-	if len(req.Form["offset_id"]) > 1 {
+	postID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
+	if err != nil {
+		log.Error(err)
 		res := map[string]interface{}{
 			"code":   http.StatusBadRequest,
 			"result": false,
-			"msg":    "Invalid offset id.",
+			"msg":    "Error occurred parsing post id.",
 		}
 		respondJson(w, res, http.StatusBadRequest)
 		return
-	} else if len(req.Form["offset_id"]) == 1 {
-		offsetID64, err := strconv.ParseUint(req.Form["offset_id"][0], 10, 32)
+	}
+	postID := uint(postID64)
+	var revisions [2]PostRevision
+	for i, key := range []string{"from", "to"} {
+		if len(req.Form[key]) != 1 {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid " + key + " revision.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		revisionID64, err := strconv.ParseUint(req.Form[key][0], 10, 32)
 		if err != nil {
 			log.Error(err)
 			res := map[string]interface{}{
 				"code":   http.StatusBadRequest,
 				"result": false,
-				"msg":    "Error occurred parsing offset id.",
+				"msg":    "Error occurred parsing " + key + " revision id.",
 			}
 			respondJson(w, res, http.StatusBadRequest)
 			return
 		}
-		offsetID = uint(offsetID64)
-	} else {
-		offsetID = 0
+		revisions[i], err = FindPostRevision(db, postID, uint(revisionID64))
+		if err != nil {
+			log.Error(err)
+			if strings.Contains(err.Error(), "record not found") {
+				res := map[string]interface{}{
+					"code":   http.StatusNotFound,
+					"result": false,
+					"msg":    "Revision not found.",
+				}
+				respondJson(w, res, http.StatusNotFound)
+				return
+			}
+			res := map[string]interface{}{
+				"code":   http.StatusInternalServerError,
+				"result": false,
+				"msg":    "Error occurred querying revision from database.",
+			}
+			respondJson(w, res, http.StatusInternalServerError)
+			return
+		}
 	}
-	posts, err := FindPosts(db, offsetID)
+	diff, err := DiffPostRevisions(revisions[0], revisions[1])
 	if err != nil {
 		log.Error(err)
 		res := map[string]interface{}{
 			"code":   http.StatusInternalServerError,
 			"result": false,
-			"msg":    "Error occurred querying posts.",
+			"msg":    "Error occurred computing diff.",
 		}
 		respondJson(w, res, http.StatusInternalServerError)
 		return
@@ -744,12 +3416,17 @@ func ListPost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	res := map[string]interface{}{
 		"code":   http.StatusOK,
 		"result": true,
-		"data":   posts,
+		"data":   diff,
 	}
 	respondJson(w, res, http.StatusOK)
 }
 
-func GetPost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+func RestorePost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	admin, token := authenticate(w, req)
+	if !checkPostPermission(w, admin, token, ps.ByName("id")) {
+		return
+	}
+
 	postID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
 	if err != nil {
 		log.Error(err)
@@ -762,14 +3439,30 @@ func GetPost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		return
 	}
 	postID := uint(postID64)
-	post, err := FindPost(db, postID)
+	revisionID64, err := strconv.ParseUint(ps.ByName("rev"), 10, 32)
+	if err != nil {
+		log.Error(err)
+		res := map[string]interface{}{
+			"code":   http.StatusBadRequest,
+			"result": false,
+			"msg":    "Error occurred parsing revision id.",
+		}
+		respondJson(w, res, http.StatusBadRequest)
+		return
+	}
+	revisionID := uint(revisionID64)
+	var updatedByID uint
+	if admin != nil {
+		updatedByID = admin.ID
+	}
+	post, err := RestorePostRevision(db, postID, revisionID, authorName(admin, token), updatedByID)
 	if err != nil {
 		log.Error(err)
 		if strings.Contains(err.Error(), "record not found") {
 			res := map[string]interface{}{
 				"code":   http.StatusNotFound,
 				"result": false,
-				"msg":    "Post not found.",
+				"msg":    "Revision not found.",
 			}
 			respondJson(w, res, http.StatusNotFound)
 			return
@@ -777,7 +3470,7 @@ func GetPost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 		res := map[string]interface{}{
 			"code":   http.StatusInternalServerError,
 			"result": false,
-			"msg":    "Error occurred querying post from database.",
+			"msg":    "Error occurred storing post to database.",
 		}
 		respondJson(w, res, http.StatusInternalServerError)
 		return
@@ -790,71 +3483,83 @@ func GetPost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	respondJson(w, res, http.StatusOK)
 }
 
-func CreatePost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	if !checkAdmin(w, req) {
-		return
-	}
-
+func SearchAll(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	req.ParseForm()
-	var post Post
-	if len(req.Form["content"]) == 1 {
-		post.Content = req.Form["content"][0]
-	}
-	if len(req.Form["title"]) == 1 {
-		post.Title = req.Form["title"][0]
-	}
-	post, err := StorePost(db, post)
-	if err != nil {
-		log.Error(err)
+	if len(req.Form["q"]) != 1 || strings.TrimSpace(req.Form["q"][0]) == "" {
 		res := map[string]interface{}{
-			"code":   http.StatusInternalServerError,
+			"code":   http.StatusBadRequest,
 			"result": false,
-			"msg":    "Error occurred storing post to database.",
+			"msg":    "Invalid search query.",
 		}
-		respondJson(w, res, http.StatusInternalServerError)
+		respondJson(w, res, http.StatusBadRequest)
 		return
 	}
-	res := map[string]interface{}{
-		"code":   http.StatusOK,
-		"result": true,
-		"data":   post,
-	}
-	respondJson(w, res, http.StatusOK)
-}
-
-func EditPost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	if !checkAdmin(w, req) {
-		return
+	filter := SearchFilter{All: isAdmin(w, req)}
+	for _, typ := range req.Form["type"] {
+		if typ != SearchTypePost && typ != SearchTypeIndex && typ != SearchTypeComment {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid search type.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		filter.Types = append(filter.Types, typ)
 	}
-
-	req.ParseForm()
-	var post Post
-	postID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
-	if err != nil {
-		log.Error(err)
+	var cursor *SearchCursor
+	if len(req.Form["cursor"]) > 1 {
 		res := map[string]interface{}{
 			"code":   http.StatusBadRequest,
 			"result": false,
-			"msg":    "Error occurred parsing index id.",
+			"msg":    "Invalid cursor.",
 		}
 		respondJson(w, res, http.StatusBadRequest)
 		return
+	} else if len(req.Form["cursor"]) == 1 {
+		c, err := ParseSearchCursor(req.Form["cursor"][0])
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Error occurred parsing cursor.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		cursor = &c
 	}
-	postID := uint(postID64)
-	post.ID = postID
-	if len(req.Form["content"]) == 1 {
-		post.Content = req.Form["content"][0]
-	}
-	if len(req.Form["title"]) == 1 {
-		post.Title = req.Form["title"][0]
+	limit := 10
+	if len(req.Form["limit"]) == 1 {
+		limit64, err := strconv.ParseUint(req.Form["limit"][0], 10, 32)
+		if err != nil || limit64 == 0 || limit64 > 50 {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid limit, must be between 1 and 50.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		limit = int(limit64)
 	}
-	post, err = UpdatePost(db, post)
+	results, err := Search(db, req.Form["q"][0], filter, cursor, limit)
 	if err != nil {
 		log.Error(err)
+		if errors.Cause(err) == ErrSearchUnavailable {
+			res := map[string]interface{}{
+				"code":   http.StatusNotImplemented,
+				"result": false,
+				"msg":    "Search is not available on this server.",
+			}
+			respondJson(w, res, http.StatusNotImplemented)
+			return
+		}
 		res := map[string]interface{}{
 			"code":   http.StatusInternalServerError,
 			"result": false,
-			"msg":    "Error occurred storing post to database.",
+			"msg":    "Error occurred searching.",
 		}
 		respondJson(w, res, http.StatusInternalServerError)
 		return
@@ -862,42 +3567,104 @@ func EditPost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	res := map[string]interface{}{
 		"code":   http.StatusOK,
 		"result": true,
-		"data":   post,
+		"data":   results,
+	}
+	if len(results) == limit {
+		last := results[len(results)-1]
+		res["next_cursor"] = SearchCursor{Score: last.Score, RowID: last.RowID}.String()
 	}
 	respondJson(w, res, http.StatusOK)
 }
 
-func DeletePost(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	if !checkAdmin(w, req) {
+// GetFeed serves /v2/feed/posts.{rss,atom,json} and, given a comment_zone_id,
+// /v2/feed/comments.{rss,atom,json}. The content parameter chooses between
+// full and excerpt content.
+func GetFeed(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	req.ParseForm()
+	name := ps.ByName("name")
+	dot := strings.LastIndex(name, ".")
+	if dot < 0 || feedContentTypes[name[dot+1:]] == "" {
+		res := map[string]interface{}{
+			"code":   http.StatusNotFound,
+			"result": false,
+			"msg":    "Feed not found.",
+		}
+		respondJson(w, res, http.StatusNotFound)
 		return
 	}
-
-	postID64, err := strconv.ParseUint(ps.ByName("id"), 10, 32)
-	if err != nil {
-		log.Error(err)
+	kind, format := name[:dot], name[dot+1:]
+	full := GlobCfg.FEED.FULL_CONTENT
+	if len(req.Form["content"]) == 1 {
+		full = req.Form["content"][0] != "excerpt"
+	}
+	var feed *feeds.Feed
+	var commentZoneID64 uint64
+	var err error
+	switch kind {
+	case "posts":
+		feed, err = PostFeed(db, GlobCfg.FEED, full)
+	case "comments":
+		if len(req.Form["comment_zone_id"]) != 1 {
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Invalid comment zone.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		commentZoneID64, err = strconv.ParseUint(req.Form["comment_zone_id"][0], 10, 32)
+		if err != nil {
+			log.Error(err)
+			res := map[string]interface{}{
+				"code":   http.StatusBadRequest,
+				"result": false,
+				"msg":    "Error occurred parsing comment zone id.",
+			}
+			respondJson(w, res, http.StatusBadRequest)
+			return
+		}
+		feed, err = CommentFeed(db, GlobCfg.FEED, uint(commentZoneID64), full)
+	default:
 		res := map[string]interface{}{
-			"code":   http.StatusBadRequest,
+			"code":   http.StatusNotFound,
 			"result": false,
-			"msg":    "Error occurred parsing index id.",
+			"msg":    "Feed not found.",
 		}
-		respondJson(w, res, http.StatusBadRequest)
+		respondJson(w, res, http.StatusNotFound)
 		return
 	}
-	postID := uint(postID64)
-	err = RemovePost(db, postID)
+	var body string
+	if err == nil {
+		body, err = RenderFeed(feed, format)
+	}
 	if err != nil {
 		log.Error(err)
 		res := map[string]interface{}{
 			"code":   http.StatusInternalServerError,
 			"result": false,
-			"msg":    "Error occurred removing post from database.",
+			"msg":    "Error occurred generating feed.",
 		}
 		respondJson(w, res, http.StatusInternalServerError)
 		return
 	}
-	res := map[string]interface{}{
-		"code":   http.StatusOK,
-		"result": true,
+	sum := sha1.Sum([]byte(body))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	if !feed.Updated.IsZero() {
+		w.Header().Set("Last-Modified", feed.Updated.UTC().Format(http.TimeFormat))
 	}
-	respondJson(w, res, http.StatusOK)
+	notModified := false
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		notModified = match == etag || match == "*"
+	} else if since, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && !feed.Updated.IsZero() {
+		notModified = !feed.Updated.Truncate(time.Second).After(since)
+	}
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", feedContentTypes[format])
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(body))
 }
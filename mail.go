@@ -0,0 +1,150 @@
+package kotori
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yanzay/log"
+)
+
+// Mail is a plain text email.
+type Mail struct {
+	To      []string
+	Subject string
+	Body    string
+	Headers map[string]string
+}
+
+// Mailer delivers mail. SMTPMailer is the implementation used by the server;
+// library users may provide their own.
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// SMTPMailer sends mail through an SMTP server, authenticating with PLAIN
+// when Username is set.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(mail Mail) (err error) {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	msg, err := m.message(mail)
+	if err == nil {
+		err = smtp.SendMail(m.Addr, auth, m.From, mail.To, msg)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "SMTPMailer.Send")
+		return
+	}
+	return
+}
+
+func (m SMTPMailer) message(mail Mail) (msg []byte, err error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", m.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(mail.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mail.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	for key, value := range mail.Headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&buf)
+	_, err = w.Write([]byte(strings.Replace(mail.Body, "\n", "\r\n", -1)))
+	if err == nil {
+		err = w.Close()
+	}
+	msg = buf.Bytes()
+	return
+}
+
+// mailRetryDelay is how long MailQueue waits before the first retry of a
+// failed mail. The delay doubles with every further attempt.
+var mailRetryDelay = 30 * time.Second
+
+// MailQueue sends mail in the background so that requests never wait for
+// delivery. Mails that fail are retried up to retries times.
+type MailQueue struct {
+	mailer  Mailer
+	retries int
+	mails   chan queuedMail
+	stop    chan struct{}
+}
+
+type queuedMail struct {
+	Mail
+	attempt int
+}
+
+func NewMailQueue(mailer Mailer, retries int) *MailQueue {
+	return &MailQueue{
+		mailer:  mailer,
+		retries: retries,
+		mails:   make(chan queuedMail, 100),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Enqueue schedules mail for delivery. If the queue is full the mail is
+// dropped rather than blocking the caller.
+func (q *MailQueue) Enqueue(mail Mail) {
+	q.enqueue(queuedMail{Mail: mail})
+}
+
+func (q *MailQueue) enqueue(mail queuedMail) {
+	select {
+	case q.mails <- mail:
+	default:
+		log.Warning("Mail queue full, dropping mail to ", strings.Join(mail.To, ", "))
+	}
+}
+
+// Run delivers queued mail until Close is called.
+func (q *MailQueue) Run() {
+	for {
+		select {
+		case <-q.stop:
+			return
+		case mail := <-q.mails:
+			q.deliver(mail)
+		}
+	}
+}
+
+func (q *MailQueue) deliver(mail queuedMail) {
+	err := q.mailer.Send(mail.Mail)
+	if err == nil {
+		return
+	}
+	log.Error(err)
+	if mail.attempt >= q.retries {
+		log.Warning("Giving up sending mail to ", strings.Join(mail.To, ", "))
+		return
+	}
+	delay := mailRetryDelay << uint(mail.attempt)
+	mail.attempt++
+	time.AfterFunc(delay, func() {
+		q.enqueue(mail)
+	})
+}
+
+func (q *MailQueue) Close() {
+	close(q.stop)
+}
@@ -0,0 +1,185 @@
+package kotori
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpSink is a minimal SMTP server collecting the messages it receives. It
+// rejects as many transactions as failures with a transient error first.
+type smtpSink struct {
+	listener net.Listener
+	messages chan string
+
+	mu       sync.Mutex
+	failures int
+	attempts int
+}
+
+func newSMTPSink(t *testing.T, failures int) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &smtpSink{listener: listener, messages: make(chan string, 10), failures: failures}
+	go sink.serve()
+	t.Cleanup(func() { listener.Close() })
+	return sink
+}
+
+func (s *smtpSink) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *smtpSink) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpSink) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 localhost ESMTP sink")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL":
+			s.mu.Lock()
+			s.attempts++
+			fail := s.attempts <= s.failures
+			s.mu.Unlock()
+			if fail {
+				reply("451 try again later")
+			} else {
+				reply("250 ok")
+			}
+		case "RCPT", "RSET", "NOOP":
+			reply("250 ok")
+		case "DATA":
+			reply("354 end with <CRLF>.<CRLF>")
+			var msg strings.Builder
+			for {
+				line, err = r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				msg.WriteString(line)
+			}
+			s.messages <- msg.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *smtpSink) receive(t *testing.T) string {
+	select {
+	case msg := <-s.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+		return ""
+	}
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	sink := newSMTPSink(t, 0)
+	mailer := SMTPMailer{Addr: sink.Addr(), From: "kotori@example.com"}
+	err := mailer.Send(Mail{
+		To:      []string{"reader@example.com"},
+		Subject: "Re: こんにちは",
+		Body:    "Someone replied to you.\nSee you there.",
+		Headers: map[string]string{"List-Unsubscribe": "<https://example.com/v2/unsubscribe>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := sink.receive(t)
+	for _, want := range []string{
+		"From: kotori@example.com\r\n",
+		"To: reader@example.com\r\n",
+		"Subject: =?utf-8?q?",
+		"List-Unsubscribe: <https://example.com/v2/unsubscribe>\r\n",
+		"Content-Transfer-Encoding: quoted-printable\r\n",
+		"Someone replied to you.\r\nSee you there.",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message lacks %q:\n%s", want, msg)
+		}
+	}
+}
+
+func TestSMTPMailerSendTransientFailure(t *testing.T) {
+	sink := newSMTPSink(t, 1)
+	mailer := SMTPMailer{Addr: sink.Addr(), From: "kotori@example.com"}
+	if err := mailer.Send(Mail{To: []string{"reader@example.com"}, Body: "hello"}); err == nil {
+		t.Fatal("expected the rejected mail to fail")
+	}
+}
+
+func TestMailQueueRetries(t *testing.T) {
+	delay := mailRetryDelay
+	mailRetryDelay = 10 * time.Millisecond
+	defer func() { mailRetryDelay = delay }()
+
+	sink := newSMTPSink(t, 2)
+	queue := NewMailQueue(SMTPMailer{Addr: sink.Addr(), From: "kotori@example.com"}, 2)
+	go queue.Run()
+	defer queue.Close()
+	queue.Enqueue(Mail{To: []string{"reader@example.com"}, Subject: "retry", Body: "hello"})
+	if msg := sink.receive(t); !strings.Contains(msg, "hello") {
+		t.Errorf("unexpected message:\n%s", msg)
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.attempts != 3 {
+		t.Errorf("got %d attempts, want 3", sink.attempts)
+	}
+}
+
+func TestMailQueueGivesUp(t *testing.T) {
+	delay := mailRetryDelay
+	mailRetryDelay = 10 * time.Millisecond
+	defer func() { mailRetryDelay = delay }()
+
+	sink := newSMTPSink(t, 10)
+	queue := NewMailQueue(SMTPMailer{Addr: sink.Addr(), From: "kotori@example.com"}, 1)
+	go queue.Run()
+	defer queue.Close()
+	queue.Enqueue(Mail{To: []string{"reader@example.com"}, Body: "hello"})
+	select {
+	case msg := <-sink.messages:
+		t.Fatalf("mail delivered despite failures:\n%s", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.attempts != 2 {
+		t.Errorf("got %d attempts, want 2", sink.attempts)
+	}
+}
@@ -1,86 +1,181 @@
 package kotori
 
 import (
+	"fmt"
+	"github.com/gosimple/slug"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
-	CommentBonus = 50
+	CommentStatusPending  = "pending"
+	CommentStatusApproved = "approved"
+	CommentStatusSpam     = "spam"
+	CommentStatusRejected = "rejected"
 )
 
+const (
+	PostStatusDraft     = "draft"
+	PostStatusPublished = "published"
+	PostStatusScheduled = "scheduled"
+	PostStatusPrivate   = "private"
+)
+
+// Admin is an account allowed to log in, with the permissions of its Role.
+// Accounts used to be listed in the config file, whence they are imported.
 type Admin struct {
-	Username string
-	Password string
+	ID        uint      `gorm:"AUTO_INCREMENT" json:"id" toml:"-"`
+	Username  string    `gorm:"not null;unique_index" json:"username" toml:"username"`
+	Password  string    `gorm:"not null" json:"-" toml:"password"`
+	Role      string    `gorm:"not null;default:'owner'" json:"role" toml:"-"`
+	Name      string    `json:"name" toml:"-"`
+	Email     string    `json:"email" toml:"-"`
+	CreatedAt time.Time `json:"created_at" toml:"-"`
+	UpdatedAt time.Time `json:"updated_at" toml:"-"`
 }
 
 type Index struct {
-	ID    uint   `gorm:"AUTO_INCREMENT" json:"id"`
-	Class string `gorm:"not null" json:"class"`
-	Title string `json:"title"`
-	Attr  string `json:"attr"`
+	ID          uint         `gorm:"AUTO_INCREMENT" json:"id"`
+	Class       string       `gorm:"not null" json:"class"`
+	Title       string       `json:"title"`
+	Attr        string       `json:"attr"`
+	AuthorID    uint         `gorm:"not null;default:0" json:"author_id"`
+	Author      *Author      `gorm:"foreignkey:AuthorID" json:"author"`
+	UpdatedByID uint         `gorm:"not null;default:0" json:"updated_by_id"`
+	UpdatedBy   *Author      `gorm:"foreignkey:UpdatedByID" json:"updated_by"`
+	CommentZone *CommentZone `gorm:"foreignkey:IndexID" json:"comment_zone"`
 }
 
 type User struct {
-	ID      uint   `gorm:"AUTO_INCREMENT" json:"id"`
-	Name    string `json:"name"`
-	Email   string `gorm:"not null;unique" json:"email"`
-	Website string `json:"website"`
-	Rank    int64  `json:"rank"`
-	Honor   string `json:"honor"`
+	ID          uint   `gorm:"AUTO_INCREMENT" json:"id"`
+	Name        string `json:"name"`
+	Email       string `gorm:"not null;unique" json:"email"`
+	Website     string `json:"website"`
+	Rank        int64  `json:"rank"`
+	Honor       string `json:"honor"`
+	EmailOptOut bool   `gorm:"not null;default:false" json:"email_opt_out"`
 }
 
 type Comment struct {
-	ID            uint      `gorm:"AUTO_INCREMENT" json:"id"`
-	CommentZoneID uint      `json:"comment_zone_id"`
-	FatherID      uint      `json:"father_id"`
-	ReplyUserID   uint      `json:"reply_user_id"`
-	ReplyUser     User      `json:"reply_user"`
-	UserID        uint      `json:"user_id"`
-	User          User      `json:"user"`
-	Content       string    `json:"content"`
-	Type          string    `json:"type"`
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	ID            uint           `gorm:"AUTO_INCREMENT" json:"id"`
+	CommentZoneID uint           `json:"comment_zone_id"`
+	FatherID      uint           `gorm:"index" json:"father_id"`
+	ReplyUserID   uint           `json:"reply_user_id"`
+	ReplyUser     User           `json:"reply_user"`
+	UserID        uint           `json:"user_id"`
+	User          User           `json:"user"`
+	Content       string         `json:"content"`
+	Format        string         `gorm:"not null;default:'markdown'" json:"format"`
+	ContentHTML   string         `gorm:"type:text" json:"content_html"`
+	Type          string         `json:"type"`
+	Status        string         `gorm:"not null;default:'approved';index" json:"status"`
+	SpamScore     float64        `gorm:"not null;default:0" json:"spam_score"`
+	SpamScores    []SpamScore    `json:"spam_scores,omitempty"`
+	SpamClass     string         `gorm:"not null;default:''" json:"spam_class"`
+	ReplyCount    int            `gorm:"-" json:"reply_count"`
+	Upvotes       int            `gorm:"not null;default:0" json:"upvotes"`
+	Downvotes     int            `gorm:"not null;default:0" json:"downvotes"`
+	Score         float64        `gorm:"not null;default:0" json:"score"`
+	Reactions     map[string]int `gorm:"-" json:"reactions"`
+	EditedAt      *time.Time     `json:"edited_at"`
+	RemovedAt     *time.Time     `gorm:"index" json:"removed_at"`
+	RemovalID     uint           `gorm:"not null;default:0;index" json:"-"`
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
 }
 
 type Post struct {
+	ID          uint         `gorm:"AUTO_INCREMENT" json:"id"`
+	Slug        string       `gorm:"unique_index" json:"slug"`
+	Title       string       `json:"title"`
+	Content     string       `json:"content"`
+	Format      string       `gorm:"not null;default:'markdown'" json:"format"`
+	ContentHTML string       `gorm:"type:text" json:"content_html"`
+	Status      string       `gorm:"not null;default:'published';index" json:"status"`
+	PublishedAt *time.Time   `json:"published_at"`
+	AuthorID    uint         `gorm:"not null;default:0;index" json:"author_id"`
+	Author      *Author      `gorm:"foreignkey:AuthorID" json:"author"`
+	UpdatedByID uint         `gorm:"not null;default:0" json:"updated_by_id"`
+	UpdatedBy   *Author      `gorm:"foreignkey:UpdatedByID" json:"updated_by"`
+	CommentZone *CommentZone `gorm:"foreignkey:PostID" json:"comment_zone"`
+	Tags        []Tag        `gorm:"many2many:post_tags" json:"tags"`
+	Categories  []Category   `gorm:"many2many:post_categories" json:"categories"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+// PostRevision is a snapshot of the title and content of a post, taken every
+// time they are written.
+type PostRevision struct {
 	ID        uint      `gorm:"AUTO_INCREMENT" json:"id"`
+	PostID    uint      `gorm:"not null;index" json:"post_id"`
+	Author    string    `json:"author"`
 	Title     string    `json:"title"`
-	Content   string    `json:"content"`
+	Content   string    `gorm:"type:text" json:"content,omitempty"`
+	Format    string    `json:"format"`
 	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
 }
 
-func FindComments(db *gorm.DB, commentZoneID uint, fatherID uint, offsetID uint) (comments []Comment, err error) {
-	var order string
-	var offset string
-	if fatherID != 0 {
-		order = "id asc"
-		offset = "id > ?"
-	} else {
-		order = "id desc"
-		offset = "id < ?"
-	}
-	if offsetID == 0 {
-		err = db.Where("comment_zone_id = ?", commentZoneID).Where("father_id = ?", fatherID).
-			Preload("User").Preload("ReplyUser").Order(order).Limit(10).Find(&comments).Error
-	} else {
-		err = db.Where("comment_zone_id = ?", commentZoneID).Where("father_id = ?", fatherID).
-			Where(offset, offsetID).
-			Preload("User").Preload("ReplyUser").Order(order).Limit(10).Find(&comments).Error
-	}
+type Tag struct {
+	ID   uint   `gorm:"AUTO_INCREMENT" json:"id"`
+	Name string `gorm:"not null;unique_index" json:"name"`
+}
+
+type Category struct {
+	ID   uint   `gorm:"AUTO_INCREMENT" json:"id"`
+	Name string `gorm:"not null;unique_index" json:"name"`
+}
+
+// TagCount is a tag together with the number of published posts carrying it.
+type TagCount struct {
+	Tag
+	Count int `json:"count"`
+}
+
+// CategoryCount is a category together with the number of published posts in it.
+type CategoryCount struct {
+	Category
+	Count int `json:"count"`
+}
+
+// PostFilter narrows down FindPosts. Empty fields do not filter.
+type PostFilter struct {
+	Status   string
+	Tag      string
+	Category string
+	AuthorID uint
+}
+
+// PostSlug records a slug a post was previously known by, so that old links
+// keep resolving after a post is renamed.
+type PostSlug struct {
+	ID     uint   `gorm:"AUTO_INCREMENT" json:"id"`
+	Slug   string `gorm:"not null;unique_index" json:"slug"`
+	PostID uint   `gorm:"not null;index" json:"post_id"`
+}
+
+var ErrSlugTaken = errors.New("slug already in use")
+var ErrNameTaken = errors.New("name already in use")
+
+// FindRecentComments lists the latest comments and replies of a comment zone.
+func FindRecentComments(db *gorm.DB, commentZoneID uint, limit int) (comments []Comment, err error) {
+	err = db.Where("comment_zone_id = ?", commentZoneID).Where("status = ?", CommentStatusApproved).
+		Where("removed_at IS NULL").Preload("User").Order("id desc").Limit(limit).Find(&comments).Error
 	if err != nil {
-		err = errors.Wrap(err, "ListComments")
+		err = errors.Wrap(err, "FindRecentComments")
 		return
 	}
 	return
 }
 
 func CountComments(db *gorm.DB, commentZoneID uint) (count int, err error) {
-	err = db.Model(&Comment{}).Where("comment_zone_id = ?", commentZoneID).Count(&count).Error
+	err = db.Model(&Comment{}).Where("comment_zone_id = ?", commentZoneID).
+		Where("status = ?", CommentStatusApproved).Where("removed_at IS NULL").Count(&count).Error
 	if err != nil {
 		err = errors.Wrap(err, "CountComments")
 		return
@@ -88,44 +183,158 @@ func CountComments(db *gorm.DB, commentZoneID uint) (count int, err error) {
 	return
 }
 
-func StoreComment(db *gorm.DB, comment Comment) (comment_new Comment, err error) {
-	var users []User
-	var user_cnt uint
-	err = db.Model(&User{}).Where("email = ?", comment.User.Email).Find(&users).Count(&user_cnt).Error
+// FindComment returns the comment id with its users, ReplyCount and Reactions.
+func FindComment(db *gorm.DB, id uint) (comment Comment, err error) {
+	err = db.Where("id = ?", id).Preload("User").Preload("ReplyUser").First(&comment).Error
+	if err == nil {
+		comments := []Comment{comment}
+		err = fillCommentCounts(db, comments)
+		comment = comments[0]
+	}
 	if err != nil {
+		err = errors.Wrap(err, "FindComment")
+		return
+	}
+	return
+}
+
+// StoreComment saves a new comment. Unless its Status is already set, the
+// comment is approved or held for moderation according to moderation. The
+// Rank of its user changes according to rules in the same transaction.
+func StoreComment(db *gorm.DB, comment Comment, moderation ModerationConfig, rules RankConfig) (comment_new Comment,
+	err error) {
+	if comment.Format == "" {
+		comment.Format = FormatMarkdown
+	}
+	comment.ContentHTML = RenderComment(comment.Format, comment.Content)
+	tx := db.Begin()
+	var user User
+	err = tx.Where("email = ?", comment.User.Email).First(&user).Error
+	if err == nil {
+		err = tx.Model(&user).Updates(User{Name: comment.User.Name, Website: comment.User.Website}).Error
+	} else if gorm.IsRecordNotFoundError(err) {
+		user = comment.User
+		err = tx.Create(&user).Error
+	}
+	if err == nil && comment.Status == "" {
+		comment.Status, err = newCommentStatus(tx, user, moderation)
+	}
+	if err == nil {
+		comment.UserID = user.ID
+		comment.CreatedAt = time.Now()
+		comment.Score = hotScore(0, comment.CreatedAt)
+		err = tx.Set("gorm:save_associations", false).Create(&comment).Error
+	}
+	for i := 0; err == nil && i < len(comment.SpamScores); i++ {
+		comment.SpamScores[i].CommentID = comment.ID
+		err = tx.Create(&comment.SpamScores[i]).Error
+	}
+	if err == nil {
+		err = adjustCommentRank(tx, rules, Comment{}, comment)
+	}
+	if err == nil {
+		err = updateSearchIndex(tx, SearchTypeComment, comment.ID, "", comment.Content)
+	}
+	if err != nil {
+		tx.Rollback()
 		err = errors.Wrap(err, "SaveComment")
 		return
 	}
-	if user_cnt != 0 {
-		comment.UserID = users[0].ID
-		users[0].Name = comment.User.Name
-		users[0].Website = comment.User.Website
-		users[0].Rank += CommentBonus
-		db.Model(&User{}).Updates(&users[0])
-	} else {
-		db.Create(&comment.User)
-		comment.UserID = comment.User.ID
+	err = tx.Commit().Error
+	if err == nil {
+		err = db.Where("id = ?", &comment.ID).
+			Preload("User").Preload("ReplyUser").First(&comment_new).Error
 	}
-	err = db.Set("gorm:save_associations", false).Create(&comment).Error
 	if err != nil {
 		err = errors.Wrap(err, "SaveComment")
 		return
 	}
-	err = db.Where("id = ?", &comment.ID).
-		Preload("User").Preload("ReplyUser").First(&comment_new).Error
 	return
 }
 
-func RemoveComment(db *gorm.DB, id uint) (err error) {
-	var comment Comment
-	err = db.Model(&Comment{}).Where("id = ?", id).Preload("User").First(&comment).Error
+// newCommentStatus applies the moderation policies to a comment by user.
+func newCommentStatus(db *gorm.DB, user User, moderation ModerationConfig) (status string, err error) {
+	if !moderation.ENABLED {
+		return CommentStatusApproved, nil
+	}
+	if moderation.APPROVE_RANK > 0 && user.Rank >= moderation.APPROVE_RANK {
+		return CommentStatusApproved, nil
+	}
+	if moderation.APPROVE_KNOWN_USERS && user.ID != 0 {
+		var count int
+		err = db.Model(&Comment{}).Where("user_id = ? AND status = ?", user.ID, CommentStatusApproved).
+			Count(&count).Error
+		if err != nil {
+			err = errors.Wrap(err, "newCommentStatus")
+			return
+		}
+		if count != 0 {
+			return CommentStatusApproved, nil
+		}
+	}
+	return CommentStatusPending, nil
+}
+
+// FindCommentsByStatus lists the comments of every zone in status, newest
+// first, for the moderation queue.
+func FindCommentsByStatus(db *gorm.DB, status string, offsetID uint) (comments []Comment, err error) {
+	db = db.Where("status = ?", status)
+	if offsetID != 0 {
+		db = db.Where("id < ?", offsetID)
+	}
+	err = db.Preload("User").Preload("ReplyUser").Preload("SpamScores").
+		Order("id desc").Limit(20).Find(&comments).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindCommentsByStatus")
+		return
+	}
+	return
+}
+
+func CountCommentsByStatus(db *gorm.DB, status string) (count int, err error) {
+	err = db.Model(&Comment{}).Where("status = ?", status).Count(&count).Error
+	if err != nil {
+		err = errors.Wrap(err, "CountCommentsByStatus")
+		return
+	}
+	return
+}
+
+// ModerateComments moves the comments ids to status, changing the Rank of
+// their users according to rules. Comments marked as spam or approved train
+// the spam classifier accordingly. It returns the comments whose status
+// changed.
+func ModerateComments(db *gorm.DB, ids []uint, status string, rules RankConfig) (moderated []Comment, err error) {
+	tx := db.Begin()
+	var comments []Comment
+	err = tx.Where("id IN (?)", ids).Preload("User").Find(&comments).Error
+	for i := 0; err == nil && i < len(comments); i++ {
+		old := comments[i].Status
+		if status == CommentStatusSpam {
+			err = TrainSpam(tx, comments[i], SpamClassSpam)
+		} else if status == CommentStatusApproved {
+			err = TrainSpam(tx, comments[i], SpamClassHam)
+		}
+		if err != nil || old == status {
+			continue
+		}
+		previous := comments[i]
+		err = tx.Model(&comments[i]).UpdateColumn("status", status).Error
+		if err == nil {
+			err = adjustCommentRank(tx, rules, previous, comments[i])
+		}
+		moderated = append(moderated, comments[i])
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "ModerateComments")
+		return
+	}
+	err = tx.Commit().Error
 	if err != nil {
-		err = errors.Wrap(err, "RemoveComment")
+		err = errors.Wrap(err, "ModerateComments")
 		return
 	}
-	comment.User.Rank -= CommentBonus
-	db.Model(&User{}).Updates(&comment.User)
-	db.Delete(&comment)
 	return
 }
 
@@ -143,6 +352,24 @@ func UpdateUserSetHonor(db *gorm.DB, id uint, honor string) (user User, err erro
 	return
 }
 
+func FindUser(db *gorm.DB, id uint) (user User, err error) {
+	err = db.Where("id = ?", id).First(&user).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindUser")
+		return
+	}
+	return
+}
+
+func UpdateUserSetEmailOptOut(db *gorm.DB, id uint, optOut bool) (err error) {
+	err = db.Model(&User{}).Where("id = ?", id).UpdateColumn("email_opt_out", optOut).Error
+	if err != nil {
+		err = errors.Wrap(err, "UpdateUserSetEmailOptOut")
+		return
+	}
+	return
+}
+
 func FindIndexes(db *gorm.DB, class string, order string, offsetID uint) (indexes []Index, err error) {
 	var offset string
 	if order == "asc" {
@@ -150,6 +377,7 @@ func FindIndexes(db *gorm.DB, class string, order string, offsetID uint) (indexe
 	} else {
 		offset = "id < ?"
 	}
+	db = db.Preload("Author").Preload("UpdatedBy").Preload("CommentZone")
 	if offsetID == 0 {
 		err = db.Where("class = ?", class).Order("id " + order).Limit(20).Find(&indexes).Error
 	} else {
@@ -160,31 +388,53 @@ func FindIndexes(db *gorm.DB, class string, order string, offsetID uint) (indexe
 		err = errors.Wrap(err, "ListComments")
 		return
 	}
+	for i := range indexes {
+		if indexes[i].CommentZone != nil {
+			indexes[i].CommentZone.fillState(nil)
+		}
+	}
 	return
 }
 
 func FindIndex(db *gorm.DB, id uint) (index Index, err error) {
-	err = db.Where("id = ?", id).Find(&index).Error
+	err = db.Where("id = ?", id).Preload("Author").Preload("UpdatedBy").Preload("CommentZone").Find(&index).Error
 	if err != nil {
 		err = errors.Wrap(err, "FindIndex")
 		return
 	}
+	if index.CommentZone != nil {
+		index.CommentZone.fillState(nil)
+	}
 	return
 }
 
 func FindIndexByTitle(db *gorm.DB, title string) (index Index, err error) {
-	err = db.Where("title = ?", title).Find(&index).Error
+	err = db.Where("title = ?", title).Preload("Author").Preload("UpdatedBy").Preload("CommentZone").Find(&index).Error
 	if err != nil {
 		err = errors.Wrap(err, "FindIndexByTitle")
 		return
 	}
+	if index.CommentZone != nil {
+		index.CommentZone.fillState(nil)
+	}
 	return
 }
 
+// StoreIndex creates index, and the comment zone of index.CommentZone if not
+// nil.
 func StoreIndex(db *gorm.DB, index Index) (index_new Index, err error) {
-	err = db.Create(&index).Error
+	err = db.Set("gorm:save_associations", false).Create(&index).Error
+	if err == nil && index.CommentZone != nil {
+		index.CommentZone.IndexID = index.ID
+		*index.CommentZone, err = StoreCommentZone(db, *index.CommentZone)
+	}
 	if err != nil {
-		err = errors.Wrap(err, "SaveComment")
+		err = errors.Wrap(err, "StoreIndex")
+		return
+	}
+	err = updateSearchIndex(db, SearchTypeIndex, index.ID, index.Title, index.Attr)
+	if err != nil {
+		err = errors.Wrap(err, "StoreIndex")
 		return
 	}
 	index_new = index
@@ -197,12 +447,36 @@ func UpdateIndex(db *gorm.DB, index Index) (index_new Index, err error) {
 		err = errors.Wrap(err, "UpdateIndex")
 		return
 	}
+	var stored Index
+	err = db.Where("id = ?", index.ID).First(&stored).Error
+	if err == nil {
+		err = updateSearchIndex(db, SearchTypeIndex, stored.ID, stored.Title, stored.Attr)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "UpdateIndex")
+		return
+	}
 	index_new = index
 	return
 }
 
+// RemoveIndex deletes an index and its search entry, and closes its comment
+// zone.
 func RemoveIndex(db *gorm.DB, id uint) (err error) {
-	err = db.Delete(Index{}, "id = ?", id).Error
+	tx := db.Begin()
+	err = tx.Delete(Index{}, "id = ?", id).Error
+	if err == nil {
+		err = closeCommentZones(tx, "index_id = ?", id)
+	}
+	if err == nil {
+		err = removeFromSearchIndex(tx, SearchTypeIndex, id)
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "RemoveIndex")
+		return
+	}
+	err = tx.Commit().Error
 	if err != nil {
 		err = errors.Wrap(err, "RemoveIndex")
 		return
@@ -210,31 +484,182 @@ func RemoveIndex(db *gorm.DB, id uint) (err error) {
 	return
 }
 
-func FindPosts(db *gorm.DB, offsetID uint) (posts []Post, err error) {
+func FindPosts(db *gorm.DB, filter PostFilter, offsetID uint) (posts []Post, err error) {
+	db = db.Select("posts.*")
+	if filter.Status != "" {
+		db = db.Where("posts.status = ?", filter.Status)
+	}
+	if filter.Tag != "" {
+		db = db.Joins("JOIN post_tags ON post_tags.post_id = posts.id").
+			Joins("JOIN tags ON tags.id = post_tags.tag_id").Where("tags.name = ?", filter.Tag)
+	}
+	if filter.Category != "" {
+		db = db.Joins("JOIN post_categories ON post_categories.post_id = posts.id").
+			Joins("JOIN categories ON categories.id = post_categories.category_id").
+			Where("categories.name = ?", filter.Category)
+	}
+	if filter.AuthorID != 0 {
+		db = db.Where("posts.author_id = ?", filter.AuthorID)
+	}
+	db = db.Preload("Tags").Preload("Categories").Preload("Author").Preload("UpdatedBy").Preload("CommentZone")
 	if offsetID == 0 {
-		err = db.Order("id desc").Limit(15).Find(&posts).Error
+		err = db.Order("posts.id desc").Limit(15).Find(&posts).Error
 	} else {
-		err = db.Order("id desc").Limit(15).
-			Where("id < ?", offsetID).Find(&posts).Error
+		err = db.Order("posts.id desc").Limit(15).
+			Where("posts.id < ?", offsetID).Find(&posts).Error
 	}
 	if err != nil {
 		err = errors.Wrap(err, "FindPosts")
 		return
 	}
+	for i := range posts {
+		posts[i].fillCommentZone()
+	}
 	return
 }
 
 func FindPost(db *gorm.DB, id uint) (post Post, err error) {
-	err = db.Where("id = ?", id).Find(&post).Error
+	err = db.Where("id = ?", id).Preload("Tags").Preload("Categories").Preload("Author").Preload("UpdatedBy").
+		Preload("CommentZone").Find(&post).Error
 	if err != nil {
 		err = errors.Wrap(err, "FindPost")
 		return
 	}
+	post.fillCommentZone()
 	return
 }
 
-func StorePost(db *gorm.DB, post Post) (post_new Post, err error) {
-	err = db.Create(&post).Error
+// fillCommentZone sets the state of the preloaded CommentZone of post.
+func (post *Post) fillCommentZone() {
+	if post.CommentZone != nil {
+		post.CommentZone.fillState(post.PublishedAt)
+	}
+}
+
+// FindPostBySlug resolves a current or previous slug. moved is true if slug is
+// a previous one, in which case post.Slug holds the canonical slug.
+func FindPostBySlug(db *gorm.DB, slug string) (post Post, moved bool, err error) {
+	var posts []Post
+	preloaded := db.Preload("Tags").Preload("Categories").Preload("Author").Preload("UpdatedBy").
+		Preload("CommentZone")
+	err = preloaded.Where("slug = ?", slug).Find(&posts).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindPostBySlug")
+		return
+	}
+	if len(posts) != 0 {
+		post = posts[0]
+		post.fillCommentZone()
+		return
+	}
+	var postSlug PostSlug
+	err = db.Where("slug = ?", slug).First(&postSlug).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindPostBySlug")
+		return
+	}
+	err = preloaded.Where("id = ?", postSlug.PostID).First(&post).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindPostBySlug")
+		return
+	}
+	post.fillCommentZone()
+	moved = true
+	return
+}
+
+// MakeSlug turns text into a URL friendly slug, transliterating non-Latin
+// scripts. It returns an empty string if nothing usable is left.
+func MakeSlug(text string) string {
+	return slug.Make(text)
+}
+
+// postSlugTaken reports whether s is the current or a previous slug of any
+// post other than postID.
+func postSlugTaken(db *gorm.DB, s string, postID uint) (taken bool, err error) {
+	var count int
+	err = db.Model(&Post{}).Where("slug = ?", s).Where("id <> ?", postID).Count(&count).Error
+	if err != nil || count != 0 {
+		taken = count != 0
+		return
+	}
+	err = db.Model(&PostSlug{}).Where("slug = ?", s).Where("post_id <> ?", postID).Count(&count).Error
+	taken = count != 0
+	return
+}
+
+// isSlugConflict reports whether err comes from the unique index on a slug,
+// which happens when another request takes the slug between postSlugTaken
+// and the write.
+func isSlugConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed") &&
+		strings.Contains(err.Error(), ".slug")
+}
+
+// uniquePostSlug derives a free slug from title by appending a counter if needed.
+func uniquePostSlug(db *gorm.DB, title string, postID uint) (s string, err error) {
+	base := MakeSlug(title)
+	if base == "" {
+		base = "post"
+	}
+	s = base
+	for i := 2; ; i++ {
+		var taken bool
+		taken, err = postSlugTaken(db, s, postID)
+		if err != nil || !taken {
+			return
+		}
+		s = base + "-" + strconv.Itoa(i)
+	}
+}
+
+func StorePost(db *gorm.DB, post Post, author string) (post_new Post, err error) {
+	if post.Slug == "" {
+		post.Slug, err = uniquePostSlug(db, post.Title, 0)
+	} else {
+		var taken bool
+		taken, err = postSlugTaken(db, post.Slug, 0)
+		if err == nil && taken {
+			err = ErrSlugTaken
+		}
+	}
+	if err != nil {
+		err = errors.Wrap(err, "StorePost")
+		return
+	}
+	if post.Status == PostStatusPublished && post.PublishedAt == nil {
+		now := time.Now()
+		post.PublishedAt = &now
+	}
+	if post.Format == "" {
+		post.Format = FormatMarkdown
+	}
+	post.ContentHTML = RenderPost(post.Format, post.Content)
+	tx := db.Begin()
+	err = tx.Set("gorm:save_associations", false).Create(&post).Error
+	if err == nil {
+		err = replacePostTerms(tx, &post)
+	}
+	if err == nil && post.CommentZone != nil {
+		post.CommentZone.PostID = post.ID
+		*post.CommentZone, err = StoreCommentZone(tx, *post.CommentZone)
+	}
+	if err == nil {
+		err = tx.Create(&PostRevision{PostID: post.ID, Author: author,
+			Title: post.Title, Content: post.Content, Format: post.Format}).Error
+	}
+	if err == nil {
+		err = updateSearchIndex(tx, SearchTypePost, post.ID, post.Title, post.Content)
+	}
+	if isSlugConflict(err) {
+		err = ErrSlugTaken
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "StorePost")
+		return
+	}
+	err = tx.Commit().Error
 	if err != nil {
 		err = errors.Wrap(err, "StorePost")
 		return
@@ -243,8 +668,108 @@ func StorePost(db *gorm.DB, post Post) (post_new Post, err error) {
 	return
 }
 
-func UpdatePost(db *gorm.DB, post Post) (post_new Post, err error) {
-	err = db.Model(&post).Updates(post).Error
+// replacePostTerms resolves the tags and categories of post by name, creating
+// missing ones, and replaces the associations of post with them. A nil slice
+// leaves the corresponding associations untouched.
+func replacePostTerms(db *gorm.DB, post *Post) (err error) {
+	if post.Tags != nil {
+		for i := range post.Tags {
+			err = db.Where(Tag{Name: post.Tags[i].Name}).FirstOrCreate(&post.Tags[i]).Error
+			if err != nil {
+				return
+			}
+		}
+		err = db.Model(post).Association("Tags").Replace(post.Tags).Error
+		if err != nil {
+			return
+		}
+	}
+	if post.Categories != nil {
+		for i := range post.Categories {
+			err = db.Where(Category{Name: post.Categories[i].Name}).FirstOrCreate(&post.Categories[i]).Error
+			if err != nil {
+				return
+			}
+		}
+		err = db.Model(post).Association("Categories").Replace(post.Categories).Error
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// UpdatePost writes the non-zero fields of post. If the title, content or
+// format change, a revision by author is recorded.
+func UpdatePost(db *gorm.DB, post Post, author string) (post_new Post, err error) {
+	var old Post
+	err = db.Where("id = ?", post.ID).First(&old).Error
+	if err != nil {
+		err = errors.Wrap(err, "UpdatePost")
+		return
+	}
+	if post.Status == PostStatusPublished && post.PublishedAt == nil && old.PublishedAt == nil {
+		now := time.Now()
+		post.PublishedAt = &now
+	}
+	if post.Content != "" || post.Format != "" {
+		format, content := old.Format, old.Content
+		if post.Format != "" {
+			format = post.Format
+		}
+		if post.Content != "" {
+			content = post.Content
+		}
+		post.ContentHTML = RenderPost(format, content)
+	}
+	renamed := post.Slug != "" && post.Slug != old.Slug
+	if renamed {
+		var taken bool
+		taken, err = postSlugTaken(db, post.Slug, post.ID)
+		if err == nil && taken {
+			err = ErrSlugTaken
+		}
+		if err != nil {
+			err = errors.Wrap(err, "UpdatePost")
+			return
+		}
+	}
+	tx := db.Begin()
+	err = tx.Model(&post).Set("gorm:save_associations", false).Updates(post).Error
+	if err == nil {
+		err = replacePostTerms(tx, &post)
+	}
+	if err == nil && (post.Title != "" || post.Content != "" || post.Format != "") {
+		revision := PostRevision{Author: author, Title: old.Title, Content: old.Content, Format: old.Format}
+		if post.Title != "" {
+			revision.Title = post.Title
+		}
+		if post.Content != "" {
+			revision.Content = post.Content
+		}
+		if post.Format != "" {
+			revision.Format = post.Format
+		}
+		err = storePostRevision(tx, old, revision)
+	}
+	if err == nil && (post.Title != "" || post.Content != "") {
+		err = indexPost(tx, post.ID)
+	}
+	if err == nil && renamed {
+		err = tx.Where("slug = ?", post.Slug).Delete(PostSlug{}).Error
+		if err == nil && old.Slug != "" {
+			err = tx.Create(&PostSlug{Slug: old.Slug, PostID: post.ID}).Error
+		}
+	}
+	if isSlugConflict(err) {
+		err = ErrSlugTaken
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "UpdatePost")
+		return
+	}
+	err = tx.Commit().Error
 	if err != nil {
 		err = errors.Wrap(err, "UpdatePost")
 		return
@@ -253,11 +778,336 @@ func UpdatePost(db *gorm.DB, post Post) (post_new Post, err error) {
 	return
 }
 
+// storePostRevision records revision as the new state of the post old,
+// unless it equals the latest revision. Posts written before revisions existed
+// get their old state recorded first, so that the edit can be undone.
+func storePostRevision(db *gorm.DB, old Post, revision PostRevision) (err error) {
+	var latest []PostRevision
+	err = db.Where("post_id = ?", old.ID).Order("id desc").Limit(1).Find(&latest).Error
+	if err == nil && len(latest) == 0 {
+		initial := PostRevision{PostID: old.ID, Title: old.Title, Content: old.Content, Format: old.Format,
+			CreatedAt: old.UpdatedAt}
+		err = db.Create(&initial).Error
+		latest = append(latest, initial)
+	}
+	if err != nil {
+		return
+	}
+	if latest[0].Title == revision.Title && latest[0].Content == revision.Content &&
+		latest[0].Format == revision.Format {
+		return
+	}
+	revision.PostID = old.ID
+	return db.Create(&revision).Error
+}
+
+// RemovePost deletes a post along with its slugs, terms and search entry, and
+// closes its comment zone. Its revisions are kept, so that a deleted post can
+// still be recovered from them.
 func RemovePost(db *gorm.DB, id uint) (err error) {
-	err = db.Delete(Post{}, "id = ?", id).Error
+	tx := db.Begin()
+	err = tx.Delete(PostSlug{}, "post_id = ?", id).Error
+	if err == nil {
+		err = removeFromSearchIndex(tx, SearchTypePost, id)
+	}
+	if err == nil {
+		err = tx.Exec("DELETE FROM post_tags WHERE post_id = ?", id).Error
+	}
+	if err == nil {
+		err = tx.Exec("DELETE FROM post_categories WHERE post_id = ?", id).Error
+	}
+	if err == nil {
+		err = closeCommentZones(tx, "post_id = ?", id)
+	}
+	if err == nil {
+		err = tx.Delete(Post{}, "id = ?", id).Error
+	}
 	if err != nil {
+		tx.Rollback()
 		err = errors.Wrap(err, "RemovePost")
 		return
 	}
+	err = tx.Commit().Error
+	if err != nil {
+		err = errors.Wrap(err, "RemovePost")
+		return
+	}
+	return
+}
+
+// PublishScheduledPosts flips every scheduled post whose publication time is
+// not after now to published.
+func PublishScheduledPosts(db *gorm.DB, now time.Time) (count int64, err error) {
+	res := db.Model(&Post{}).Where("status = ?", PostStatusScheduled).Where("published_at <= ?", now).
+		Update("status", PostStatusPublished)
+	err = res.Error
+	if err != nil {
+		err = errors.Wrap(err, "PublishScheduledPosts")
+		return
+	}
+	count = res.RowsAffected
+	return
+}
+
+// NextScheduledPost returns the publication time of the earliest scheduled post,
+// or nil if there is none.
+func NextScheduledPost(db *gorm.DB) (next *time.Time, err error) {
+	var posts []Post
+	err = db.Where("status = ?", PostStatusScheduled).Order("published_at asc").Limit(1).Find(&posts).Error
+	if err != nil {
+		err = errors.Wrap(err, "NextScheduledPost")
+		return
+	}
+	if len(posts) != 0 {
+		next = posts[0].PublishedAt
+	}
+	return
+}
+
+// FillPostSlugs generates a slug for every post that has none, such as posts
+// created before slugs were introduced.
+func FillPostSlugs(db *gorm.DB) (err error) {
+	var posts []Post
+	err = db.Where("slug IS NULL OR slug = ''").Find(&posts).Error
+	if err != nil {
+		err = errors.Wrap(err, "FillPostSlugs")
+		return
+	}
+	for _, post := range posts {
+		var s string
+		s, err = uniquePostSlug(db, post.Title, post.ID)
+		if err == nil {
+			err = db.Model(&post).UpdateColumn("slug", s).Error
+		}
+		if err != nil {
+			err = errors.Wrap(err, "FillPostSlugs")
+			return
+		}
+	}
+	return
+}
+
+func FindTags(db *gorm.DB) (tags []TagCount, err error) {
+	err = db.Table("tags").Select("tags.*, count(posts.id) AS count").
+		Joins("LEFT JOIN post_tags ON post_tags.tag_id = tags.id").
+		Joins("LEFT JOIN posts ON posts.id = post_tags.post_id AND posts.status = ?", PostStatusPublished).
+		Group("tags.id").Order("count desc, tags.name asc").Scan(&tags).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindTags")
+		return
+	}
+	return
+}
+
+func UpdateTag(db *gorm.DB, tag Tag) (tag_new Tag, err error) {
+	var count int
+	err = db.Model(&Tag{}).Where("name = ?", tag.Name).Where("id <> ?", tag.ID).Count(&count).Error
+	if err == nil && count != 0 {
+		err = ErrNameTaken
+	}
+	if err == nil {
+		err = db.Model(&tag).Updates(tag).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "UpdateTag")
+		return
+	}
+	tag_new = tag
+	return
+}
+
+// MergeTag moves every post tagged with id over to the tag into, then removes
+// the tag id.
+func MergeTag(db *gorm.DB, id uint, into uint) (err error) {
+	var target Tag
+	err = db.Where("id = ?", into).First(&target).Error
+	if err != nil {
+		err = errors.Wrap(err, "MergeTag")
+		return
+	}
+	tx := db.Begin()
+	err = tx.Exec("INSERT INTO post_tags (post_id, tag_id) SELECT post_id, ? FROM post_tags WHERE tag_id = ? "+
+		"AND post_id NOT IN (SELECT post_id FROM post_tags WHERE tag_id = ?)", into, id, into).Error
+	if err == nil {
+		err = tx.Exec("DELETE FROM post_tags WHERE tag_id = ?", id).Error
+	}
+	if err == nil {
+		err = tx.Delete(Tag{}, "id = ?", id).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "MergeTag")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		err = errors.Wrap(err, "MergeTag")
+		return
+	}
+	return
+}
+
+func RemoveTag(db *gorm.DB, id uint) (err error) {
+	err = db.Exec("DELETE FROM post_tags WHERE tag_id = ?", id).Error
+	if err == nil {
+		err = db.Delete(Tag{}, "id = ?", id).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "RemoveTag")
+		return
+	}
+	return
+}
+
+func FindCategories(db *gorm.DB) (categories []CategoryCount, err error) {
+	err = db.Table("categories").Select("categories.*, count(posts.id) AS count").
+		Joins("LEFT JOIN post_categories ON post_categories.category_id = categories.id").
+		Joins("LEFT JOIN posts ON posts.id = post_categories.post_id AND posts.status = ?", PostStatusPublished).
+		Group("categories.id").Order("categories.name asc").Scan(&categories).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindCategories")
+		return
+	}
+	return
+}
+
+func UpdateCategory(db *gorm.DB, category Category) (category_new Category, err error) {
+	var count int
+	err = db.Model(&Category{}).Where("name = ?", category.Name).Where("id <> ?", category.ID).Count(&count).Error
+	if err == nil && count != 0 {
+		err = ErrNameTaken
+	}
+	if err == nil {
+		err = db.Model(&category).Updates(category).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "UpdateCategory")
+		return
+	}
+	category_new = category
+	return
+}
+
+func RemoveCategory(db *gorm.DB, id uint) (err error) {
+	err = db.Exec("DELETE FROM post_categories WHERE category_id = ?", id).Error
+	if err == nil {
+		err = db.Delete(Category{}, "id = ?", id).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "RemoveCategory")
+		return
+	}
+	return
+}
+
+// FillContentHTML renders every post and comment whose HTML has not been
+// cached yet, such as content created before rendering was introduced.
+func FillContentHTML(db *gorm.DB) (err error) {
+	var posts []Post
+	err = db.Where("content_html IS NULL").Find(&posts).Error
+	for i := 0; err == nil && i < len(posts); i++ {
+		err = db.Model(&posts[i]).UpdateColumn("content_html", RenderPost(posts[i].Format, posts[i].Content)).Error
+	}
+	var comments []Comment
+	if err == nil {
+		err = db.Where("content_html IS NULL").Find(&comments).Error
+	}
+	for i := 0; err == nil && i < len(comments); i++ {
+		err = db.Model(&comments[i]).UpdateColumn("content_html", RenderComment(comments[i].Format, comments[i].Content)).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "FillContentHTML")
+		return
+	}
+	return
+}
+
+// FindPostRevisions lists the revisions of a post, newest first, without
+// their content.
+func FindPostRevisions(db *gorm.DB, postID uint) (revisions []PostRevision, err error) {
+	err = db.Select("id, post_id, author, title, format, created_at").Where("post_id = ?", postID).
+		Order("id desc").Find(&revisions).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindPostRevisions")
+		return
+	}
+	return
+}
+
+func FindPostRevision(db *gorm.DB, postID uint, id uint) (revision PostRevision, err error) {
+	err = db.Where("post_id = ?", postID).Where("id = ?", id).First(&revision).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindPostRevision")
+		return
+	}
+	return
+}
+
+// DiffPostRevisions returns a unified diff turning revision from into revision to.
+func DiffPostRevisions(from PostRevision, to PostRevision) (diff string, err error) {
+	text := func(r PostRevision) []string {
+		return difflib.SplitLines(r.Title + "\n\n" + r.Content)
+	}
+	diff, err = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        text(from),
+		B:        text(to),
+		FromFile: fmt.Sprintf("revision %d", from.ID),
+		FromDate: from.CreatedAt.Format(time.RFC3339),
+		ToFile:   fmt.Sprintf("revision %d", to.ID),
+		ToDate:   to.CreatedAt.Format(time.RFC3339),
+		Context:  3,
+	})
+	if err != nil {
+		err = errors.Wrap(err, "DiffPostRevisions")
+		return
+	}
+	return
+}
+
+// RestorePostRevision writes the title, content and format of a revision back
+// to its post as they are, empty ones included, and records the result as the
+// newest revision.
+func RestorePostRevision(db *gorm.DB, postID uint, id uint, author string, updatedByID uint) (post Post, err error) {
+	revision, err := FindPostRevision(db, postID, id)
+	var old Post
+	if err == nil {
+		err = db.Where("id = ?", postID).First(&old).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "RestorePostRevision")
+		return
+	}
+	columns := map[string]interface{}{
+		"title":        revision.Title,
+		"content":      revision.Content,
+		"format":       revision.Format,
+		"content_html": RenderPost(revision.Format, revision.Content),
+		"updated_at":   time.Now(),
+	}
+	if updatedByID != 0 {
+		columns["updated_by_id"] = updatedByID
+	}
+	tx := db.Begin()
+	err = tx.Model(&Post{}).Where("id = ?", postID).UpdateColumns(columns).Error
+	if err == nil {
+		err = storePostRevision(tx, old, PostRevision{Author: author, Title: revision.Title,
+			Content: revision.Content, Format: revision.Format})
+	}
+	if err == nil {
+		err = indexPost(tx, postID)
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "RestorePostRevision")
+		return
+	}
+	err = tx.Commit().Error
+	if err == nil {
+		post, err = FindPost(db, postID)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "RestorePostRevision")
+		return
+	}
 	return
 }
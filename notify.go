@@ -0,0 +1,160 @@
+package kotori
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/yanzay/log"
+)
+
+// Templates define a "subject" and a "body" template. They are executed with
+// a commentMail.
+const defaultReplyTemplate = `{{define "subject"}}{{.Comment.User.Name}} replied to you on {{.Site}}{{end}}
+{{define "body"}}Hi {{.Recipient.Name}},
+
+{{.Comment.User.Name}} replied to your comment on {{.Site}}:
+
+{{.Comment.Content}}
+{{if .Link}}
+Join the conversation: {{.Link}}
+{{end}}
+--
+You receive this email because you commented on {{.Site}}.
+Stop receiving these emails: {{.UnsubscribeURL}}
+{{end}}`
+
+const defaultAdminTemplate = `{{define "subject"}}New comment on {{.Site}}{{if eq .Comment.Status "pending"}} awaiting moderation{{end}}{{end}}
+{{define "body"}}{{.Comment.User.Name}} <{{.Comment.User.Email}}> commented in comment zone {{.Comment.CommentZoneID}}:
+
+{{.Comment.Content}}
+
+Status: {{.Comment.Status}}
+{{if .Link}}Comment zone: {{.Link}}
+{{end}}{{end}}`
+
+type commentMail struct {
+	Site           string
+	Comment        Comment
+	Recipient      User
+	Link           string
+	UnsubscribeURL string
+}
+
+// Notifier emails users when they get a reply and admins when a comment is
+// posted. The methods of a nil Notifier do nothing, so that handlers need not
+// care whether mail is enabled.
+type Notifier struct {
+	queue *MailQueue
+	cfg   Config
+	reply *template.Template
+	admin *template.Template
+}
+
+// NewNotifier loads the templates named in cfg.MAIL, falling back to the
+// built-in ones, and sends the resulting mail through queue.
+func NewNotifier(queue *MailQueue, cfg Config) (n *Notifier, err error) {
+	n = &Notifier{queue: queue, cfg: cfg}
+	n.reply, err = loadMailTemplate(cfg.MAIL.REPLY_TEMPLATE, defaultReplyTemplate)
+	if err == nil {
+		n.admin, err = loadMailTemplate(cfg.MAIL.ADMIN_TEMPLATE, defaultAdminTemplate)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "NewNotifier")
+		return
+	}
+	return
+}
+
+func loadMailTemplate(path string, fallback string) (*template.Template, error) {
+	if path == "" {
+		return template.New("mail").Parse(fallback)
+	}
+	return template.ParseFiles(path)
+}
+
+// UnsubscribeToken signs the one-click unsubscribe link of user.
+func UnsubscribeToken(user User) string {
+	return sign("unsubscribe", strconv.FormatUint(uint64(user.ID), 10)+":"+user.Email)
+}
+
+func (n *Notifier) unsubscribeURL(user User) string {
+	return strings.TrimRight(n.cfg.MAIL.BASE_URL, "/") + "/v2/unsubscribe?" + url.Values{
+		"user_id": {strconv.FormatUint(uint64(user.ID), 10)},
+		"token":   {UnsubscribeToken(user)},
+	}.Encode()
+}
+
+func (n *Notifier) send(tmpl *template.Template, to []string, data commentMail, headers map[string]string) {
+	var subject, body bytes.Buffer
+	err := tmpl.ExecuteTemplate(&subject, "subject", data)
+	if err == nil {
+		err = tmpl.ExecuteTemplate(&body, "body", data)
+	}
+	if err != nil {
+		log.Error(errors.Wrap(err, "Notifier.send"))
+		return
+	}
+	n.queue.Enqueue(Mail{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Body:    strings.TrimLeft(body.String(), "\n"),
+		Headers: headers,
+	})
+}
+
+func (n *Notifier) commentMail(comment Comment) commentMail {
+	return commentMail{
+		Site:    n.cfg.FEED.TITLE,
+		Comment: comment,
+		Link: feedURL(n.cfg.FEED.COMMENT_ZONE_URL, map[string]string{
+			"comment_zone_id": strconv.FormatUint(uint64(comment.CommentZoneID), 10),
+		}),
+	}
+}
+
+// NotifyAdmins tells the addresses in the notify list of the mail
+// configuration about a new comment.
+func (n *Notifier) NotifyAdmins(comment Comment) {
+	if n == nil || len(n.cfg.MAIL.NOTIFY) == 0 {
+		return
+	}
+	n.send(n.admin, n.cfg.MAIL.NOTIFY, n.commentMail(comment), nil)
+}
+
+// NotifyReply tells the user comment replies to, or the author of the comment
+// it was posted under, about it, unless they opted out.
+func (n *Notifier) NotifyReply(db *gorm.DB, comment Comment) {
+	if n == nil {
+		return
+	}
+	var recipient User
+	var err error
+	if comment.ReplyUserID != 0 {
+		err = db.Where("id = ?", comment.ReplyUserID).First(&recipient).Error
+	} else if comment.FatherID != 0 {
+		var father Comment
+		err = db.Where("id = ?", comment.FatherID).Preload("User").First(&father).Error
+		recipient = father.User
+	} else {
+		return
+	}
+	if err != nil {
+		log.Error(errors.Wrap(err, "NotifyReply"))
+		return
+	}
+	if recipient.ID == 0 || recipient.ID == comment.UserID || recipient.EmailOptOut || recipient.Email == "" {
+		return
+	}
+	data := n.commentMail(comment)
+	data.Recipient = recipient
+	data.UnsubscribeURL = n.unsubscribeURL(recipient)
+	n.send(n.reply, []string{recipient.Email}, data, map[string]string{
+		"List-Unsubscribe":      "<" + data.UnsubscribeURL + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	})
+}
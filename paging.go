@@ -0,0 +1,207 @@
+package kotori
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const (
+	CommentSortNewest      = "newest"
+	CommentSortOldest      = "oldest"
+	CommentSortMostReplied = "most-replied"
+	CommentSortTop         = "top"
+)
+
+// replyCountSQL counts the listed replies of the comment of a row.
+var replyCountSQL = "(SELECT COUNT(*) FROM comments AS replies " +
+	"WHERE replies.father_id = comments.id AND replies.status = 'approved' AND " +
+	visibleCommentSQL("replies") + ")"
+
+// commentSort orders comments by expr, or by id alone when expr is empty,
+// descending unless asc. Ties are broken by id in the same direction. key
+// returns the value of expr for a loaded comment, kept in cursors.
+type commentSort struct {
+	expr string
+	asc  bool
+	key  func(comment Comment) float64
+}
+
+var commentSorts = map[string]commentSort{
+	CommentSortNewest: {},
+	CommentSortOldest: {asc: true},
+	CommentSortMostReplied: {expr: replyCountSQL, key: func(comment Comment) float64 {
+		return float64(comment.ReplyCount)
+	}},
+	CommentSortTop: {expr: "comments.score", key: func(comment Comment) float64 {
+		return comment.Score
+	}},
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+func ValidCommentSort(sort string) bool {
+	_, ok := commentSorts[sort]
+	return ok
+}
+
+// CommentQuery selects a page of Limit approved comments replying to
+// FatherID, 0 for top-level ones, in the order Sort, after Cursor.
+type CommentQuery struct {
+	CommentZoneID uint
+	FatherID      uint
+	Sort          string
+	Limit         int
+	Cursor        string
+}
+
+// commentCursor is the position after the last comment of a page, encoded
+// so that clients do not depend on it.
+type commentCursor struct {
+	Sort string  `json:"s"`
+	Key  float64 `json:"k,omitempty"`
+	ID   uint    `json:"i"`
+}
+
+func (c commentCursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseCommentCursor(s string) (c commentCursor, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		err = ErrInvalidCursor
+	}
+	return
+}
+
+// OffsetCursor returns the cursor of the comments after offsetID in the order
+// sort, for clients paging with an offset id.
+func OffsetCursor(sort string, offsetID uint) string {
+	return commentCursor{Sort: sort, ID: offsetID}.String()
+}
+
+// commentPageSize is the number of comments FindComments returns at once.
+const commentPageSize = 10
+
+// FindComments returns a page of the comments replying to fatherID, 0 for
+// top-level ones, after offsetID. Top-level comments are listed newest first
+// and replies oldest first.
+func FindComments(db *gorm.DB, commentZoneID uint, fatherID uint, offsetID uint) (comments []Comment, err error) {
+	comments, _, err = FindCommentPage(db, offsetCommentQuery(commentZoneID, fatherID, offsetID))
+	if err != nil {
+		err = errors.Wrap(err, "FindComments")
+		return
+	}
+	return
+}
+
+// offsetCommentQuery is the CommentQuery of FindComments.
+func offsetCommentQuery(commentZoneID uint, fatherID uint, offsetID uint) CommentQuery {
+	query := CommentQuery{CommentZoneID: commentZoneID, FatherID: fatherID, Sort: CommentSortNewest,
+		Limit: commentPageSize}
+	if fatherID != 0 {
+		query.Sort = CommentSortOldest
+	}
+	if offsetID != 0 {
+		query.Cursor = OffsetCursor(query.Sort, offsetID)
+	}
+	return query
+}
+
+// FindCommentPage returns the comments selected by query with their
+// ReplyCount and Reactions, and the cursor of the next page, empty on the
+// last one.
+func FindCommentPage(db *gorm.DB, query CommentQuery) (comments []Comment, next string, err error) {
+	sort, ok := commentSorts[query.Sort]
+	if !ok {
+		err = errors.Wrap(errors.New("unknown sort "+query.Sort), "FindCommentPage")
+		return
+	}
+	if query.Limit < 1 {
+		err = errors.Wrap(errors.New("limit must be positive"), "FindCommentPage")
+		return
+	}
+	cmp, dir := " < ", " desc"
+	if sort.asc {
+		cmp, dir = " > ", " asc"
+	}
+	q := db.Where("comments.comment_zone_id = ? AND comments.father_id = ? AND comments.status = ? AND "+
+		visibleCommentSQL("comments"), query.CommentZoneID, query.FatherID, CommentStatusApproved)
+	if query.Cursor != "" {
+		var c commentCursor
+		c, err = parseCommentCursor(query.Cursor)
+		if err == nil && c.Sort != query.Sort {
+			err = ErrInvalidCursor
+		}
+		if err != nil {
+			err = errors.Wrap(err, "FindCommentPage")
+			return
+		}
+		if sort.expr == "" {
+			q = q.Where("comments.id"+cmp+"?", c.ID)
+		} else {
+			q = q.Where("("+sort.expr+cmp+"? OR ("+sort.expr+" = ? AND comments.id"+cmp+"?))", c.Key, c.Key, c.ID)
+		}
+	}
+	if sort.expr != "" {
+		q = q.Order(sort.expr + dir)
+	}
+	err = q.Order("comments.id" + dir).Limit(query.Limit + 1).
+		Preload("User").Preload("ReplyUser").Find(&comments).Error
+	more := err == nil && len(comments) > query.Limit
+	if more {
+		comments = comments[:query.Limit]
+	}
+	if err == nil {
+		err = fillCommentCounts(db, comments)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "FindCommentPage")
+		return
+	}
+	if more {
+		last := comments[len(comments)-1]
+		c := commentCursor{Sort: query.Sort, ID: last.ID}
+		if sort.key != nil {
+			c.Key = sort.key(last)
+		}
+		next = c.String()
+	}
+	return
+}
+
+// fillCommentCounts sets the ReplyCount and the Reactions of comments.
+func fillCommentCounts(db *gorm.DB, comments []Comment) (err error) {
+	if len(comments) == 0 {
+		return
+	}
+	ids := make([]uint, len(comments))
+	for i := range comments {
+		ids[i] = comments[i].ID
+	}
+	var counts []struct {
+		FatherID uint
+		Count    int
+	}
+	err = db.Model(&Comment{}).Select("father_id, COUNT(*) AS count").
+		Where("status = ? AND father_id IN (?) AND "+visibleCommentSQL("comments"), CommentStatusApproved, ids).
+		Group("father_id").Scan(&counts).Error
+	if err != nil {
+		return
+	}
+	replies := make(map[uint]int, len(counts))
+	for _, c := range counts {
+		replies[c.FatherID] = c.Count
+	}
+	for i := range comments {
+		comments[i].ReplyCount = replies[comments[i].ID]
+	}
+	return fillReactions(db, comments, ids)
+}
@@ -0,0 +1,169 @@
+package kotori
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	database, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "kotori.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	if err = Migrate(database); err != nil {
+		t.Fatal(err)
+	}
+	return database
+}
+
+func storeTestComment(t *testing.T, db *gorm.DB, comment Comment) Comment {
+	t.Helper()
+	if comment.CommentZoneID == 0 {
+		comment.CommentZoneID = 1
+	}
+	if comment.Status == "" {
+		comment.Status = CommentStatusApproved
+	}
+	err := db.Set("gorm:save_associations", false).Create(&comment).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return comment
+}
+
+// storePagingComments stores top-level comments with tied scores and reply
+// counts, and returns them.
+func storePagingComments(t *testing.T, db *gorm.DB) (roots []Comment) {
+	scores := []float64{3, 1, 3, 2, 3, 1, 2}
+	replies := []int{0, 3, 1, 0, 3, 0, 1}
+	for i := range scores {
+		roots = append(roots, storeTestComment(t, db, Comment{Content: "root", Score: scores[i]}))
+	}
+	for i := range roots {
+		for j := 0; j < replies[i]; j++ {
+			storeTestComment(t, db, Comment{FatherID: roots[i].ID, Content: "reply"})
+		}
+		roots[i].ReplyCount = replies[i]
+	}
+	return
+}
+
+func TestFindCommentPageCursors(t *testing.T) {
+	db := openTestDB(t)
+	roots := storePagingComments(t, db)
+	for name, s := range commentSorts {
+		expected := make([]Comment, len(roots))
+		copy(expected, roots)
+		sort.SliceStable(expected, func(i, j int) bool {
+			if s.key != nil && s.key(expected[i]) != s.key(expected[j]) {
+				return s.key(expected[i]) > s.key(expected[j])
+			}
+			if s.asc {
+				return expected[i].ID < expected[j].ID
+			}
+			return expected[i].ID > expected[j].ID
+		})
+		var want []uint
+		for _, c := range expected {
+			want = append(want, c.ID)
+		}
+		for _, limit := range []int{1, 2, 3, len(roots), len(roots) + 1} {
+			var got []uint
+			query := CommentQuery{CommentZoneID: 1, Sort: name, Limit: limit}
+			for pages := 0; ; pages++ {
+				if pages > len(roots) {
+					t.Fatalf("%s/%d: cursors do not end", name, limit)
+				}
+				comments, next, err := FindCommentPage(db, query)
+				if err != nil {
+					t.Fatalf("%s/%d: %v", name, limit, err)
+				}
+				if len(comments) > limit {
+					t.Fatalf("%s/%d: got %d comments", name, limit, len(comments))
+				}
+				for _, c := range comments {
+					got = append(got, c.ID)
+				}
+				if next == "" {
+					break
+				}
+				query.Cursor = next
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s/%d: got %v, want %v", name, limit, got, want)
+			}
+		}
+	}
+}
+
+func TestFindCommentPageInvalid(t *testing.T) {
+	db := openTestDB(t)
+	storePagingComments(t, db)
+	query := CommentQuery{CommentZoneID: 1, Sort: CommentSortNewest, Limit: 2}
+	_, next, err := FindCommentPage(db, query)
+	if err != nil || next == "" {
+		t.Fatalf("got %q, %v", next, err)
+	}
+	for _, cursor := range []string{"garbage", "e30", next} {
+		query := CommentQuery{CommentZoneID: 1, Sort: CommentSortTop, Limit: 2, Cursor: cursor}
+		if _, _, err := FindCommentPage(db, query); errors.Cause(err) != ErrInvalidCursor {
+			t.Errorf("cursor %q: got %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+	query.Limit = 0
+	if _, _, err := FindCommentPage(db, query); err == nil {
+		t.Error("expected an error for a limit of 0")
+	}
+}
+
+func TestFindCommentsOffset(t *testing.T) {
+	db := openTestDB(t)
+	roots := storePagingComments(t, db)
+	comments, err := FindComments(db, 1, 0, roots[3].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []uint
+	for _, c := range comments {
+		got = append(got, c.ID)
+	}
+	want := []uint{roots[2].ID, roots[1].ID, roots[0].ID}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFindCommentThreadPageMoreReplies(t *testing.T) {
+	db := openTestDB(t)
+	roots := storePagingComments(t, db)
+	threads, _, err := FindCommentThreadPage(db, CommentQuery{CommentZoneID: 1, Sort: CommentSortOldest, Limit: 10},
+		1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := threads[1]
+	if node.ID != roots[1].ID || len(node.Replies) != 1 || node.MoreReplies == nil {
+		t.Fatalf("unexpected thread %+v", node)
+	}
+	if node.MoreReplies.OffsetID != node.Replies[0].ID {
+		t.Errorf("got offset id %d, want %d", node.MoreReplies.OffsetID, node.Replies[0].ID)
+	}
+	rest, next, err := FindCommentPage(db, CommentQuery{CommentZoneID: 1, FatherID: node.ID, Sort: CommentSortOldest,
+		Limit: 10, Cursor: node.MoreReplies.Cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 2 || next != "" || rest[0].ID <= node.Replies[0].ID {
+		t.Errorf("got %d more replies and cursor %q", len(rest), next)
+	}
+	if threads[0].MoreReplies != nil {
+		t.Errorf("comment without replies points to more: %+v", threads[0].MoreReplies)
+	}
+}
@@ -0,0 +1,168 @@
+package kotori
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Parameters of the argon2id hashes produced by HashPassword, as recommended
+// by RFC 9106 for memory constrained environments.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// HashPassword hashes password with argon2id in the PHC string format.
+func HashPassword(password string) (hash string, err error) {
+	salt := make([]byte, argon2SaltLen)
+	_, err = rand.Read(salt)
+	if err != nil {
+		err = errors.Wrap(err, "HashPassword")
+		return
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	hash = fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+	return
+}
+
+// IsPasswordHash reports whether password is an argon2id or bcrypt hash
+// rather than a plaintext password.
+func IsPasswordHash(password string) bool {
+	return strings.HasPrefix(password, "$argon2id$") || strings.HasPrefix(password, "$2a$") ||
+		strings.HasPrefix(password, "$2b$") || strings.HasPrefix(password, "$2y$")
+}
+
+// CheckPassword reports whether password matches hash, an argon2id or bcrypt
+// hash. For backward compatibility, a hash that is neither is compared to
+// password as plaintext. All comparisons take constant time.
+func CheckPassword(hash string, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return checkArgon2Password(hash, password)
+	}
+	if IsPasswordHash(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+}
+
+func checkArgon2Password(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// Login failures lock a client address out once they reach
+// loginFreeFailures, for loginLockout doubled with every further failure up
+// to loginMaxLockout. Failures for a username only slow its logins down, by
+// at most loginMaxDelay, so that nobody can lock the real admin out.
+const (
+	loginFreeFailures = 5
+	loginLockout      = time.Second
+	loginMaxLockout   = time.Hour
+	loginMaxDelay     = 3 * time.Second
+)
+
+type loginFailures struct {
+	count int
+	until time.Time
+}
+
+// loginGuard counts the failed logins of each username and client address.
+type loginGuard struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+var loginAttempts = &loginGuard{failures: make(map[string]*loginFailures)}
+
+// Locked returns how long the keys are still locked out, if any is.
+func (g *loginGuard) Locked(now time.Time, keys ...string) (wait time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range keys {
+		if f := g.failures[key]; f != nil && f.until.Sub(now) > wait {
+			wait = f.until.Sub(now)
+		}
+	}
+	return
+}
+
+// Delay returns how long a login for key is held back, which is how long it
+// would be locked out but at most loginMaxDelay.
+func (g *loginGuard) Delay(now time.Time, key string) time.Duration {
+	wait := g.Locked(now, key)
+	if wait > loginMaxDelay {
+		wait = loginMaxDelay
+	}
+	return wait
+}
+
+// Fail records a failed login for the keys.
+func (g *loginGuard) Fail(now time.Time, keys ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for key, f := range g.failures {
+		if now.Sub(f.until) > 24*time.Hour {
+			delete(g.failures, key)
+		}
+	}
+	for _, key := range keys {
+		f := g.failures[key]
+		if f == nil {
+			f = &loginFailures{}
+			g.failures[key] = f
+		}
+		f.count++
+		if f.count >= loginFreeFailures {
+			lockout := loginMaxLockout
+			if shift := uint(f.count - loginFreeFailures); shift < 32 && loginLockout<<shift < loginMaxLockout {
+				lockout = loginLockout << shift
+			}
+			f.until = now.Add(lockout)
+		} else {
+			f.until = now
+		}
+	}
+}
+
+// Succeed forgets the failures of the keys.
+func (g *loginGuard) Succeed(keys ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range keys {
+		delete(g.failures, key)
+	}
+}
@@ -0,0 +1,181 @@
+package kotori
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Reasons a RankEvent changes the Rank of a user.
+const (
+	RankReasonApprovedComment = "approved_comment"
+	RankReasonSpamComment     = "spam_comment"
+	RankReasonGrant           = "grant"
+)
+
+var ErrRankGrantTooLarge = errors.New("rank grant exceeds the configured maximum")
+
+// RankEvent is an entry of the ledger of rank changes: the Rank of a user is
+// the sum of the Delta of its events. Events following the rules of
+// RankConfig have a Sign of 1 when a comment starts counting for its user,
+// and -1 when it stops; those granted by an admin have a Sign of 0 and a
+// Note.
+type RankEvent struct {
+	ID        uint      `gorm:"AUTO_INCREMENT" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	CommentID uint      `gorm:"not null;default:0" json:"comment_id"`
+	AdminID   uint      `gorm:"not null;default:0" json:"admin_id"`
+	Reason    string    `gorm:"not null" json:"reason"`
+	Sign      int       `gorm:"not null;default:0" json:"sign"`
+	Delta     int64     `gorm:"not null" json:"delta"`
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ruleDelta returns what the rule of rules for reason is worth.
+func ruleDelta(rules RankConfig, reason string) int64 {
+	switch reason {
+	case RankReasonApprovedComment:
+		return rules.APPROVED_COMMENT
+	case RankReasonSpamComment:
+		return -rules.SPAM_COMMENT
+	}
+	return 0
+}
+
+// commentRankSigns tells which rules a comment counts for: approved ones earn
+// their user a bonus until removed, spam ones a penalty even once removed.
+func commentRankSigns(comment Comment) map[string]int {
+	signs := map[string]int{}
+	if comment.Status == CommentStatusApproved && comment.RemovedAt == nil {
+		signs[RankReasonApprovedComment] = 1
+	}
+	if comment.Status == CommentStatusSpam {
+		signs[RankReasonSpamComment] = 1
+	}
+	return signs
+}
+
+// adjustCommentRank records the rank events of the user of comment as it
+// changes from old, whose zero value stands for a comment not stored yet.
+func adjustCommentRank(db *gorm.DB, rules RankConfig, old Comment, comment Comment) (err error) {
+	oldSigns, signs := commentRankSigns(old), commentRankSigns(comment)
+	for _, reason := range []string{RankReasonApprovedComment, RankReasonSpamComment} {
+		sign := signs[reason] - oldSigns[reason]
+		if err == nil && sign != 0 {
+			err = adjustRank(db, RankEvent{UserID: comment.UserID, CommentID: comment.ID, Reason: reason,
+				Sign: sign, Delta: int64(sign) * ruleDelta(rules, reason)})
+		}
+	}
+	return
+}
+
+// adjustRank stores event and adds its Delta to the Rank of its user.
+func adjustRank(db *gorm.DB, event RankEvent) (err error) {
+	err = db.Create(&event).Error
+	if err == nil && event.Delta != 0 {
+		err = db.Model(&User{}).Where("id = ?", event.UserID).
+			UpdateColumn("rank", gorm.Expr("rank + ?", event.Delta)).Error
+	}
+	return
+}
+
+// GrantRank adds delta, a bonus or a penalty, to the Rank of the user id on
+// behalf of the admin adminID, unless its size exceeds the MAX_GRANT of
+// rules.
+func GrantRank(db *gorm.DB, rules RankConfig, id uint, adminID uint, delta int64, note string) (user User, err error) {
+	if rules.MAX_GRANT > 0 && (delta > rules.MAX_GRANT || delta < -rules.MAX_GRANT) {
+		err = errors.Wrap(ErrRankGrantTooLarge, "GrantRank")
+		return
+	}
+	tx := db.Begin()
+	err = tx.Where("id = ?", id).First(&user).Error
+	if err == nil {
+		err = adjustRank(tx, RankEvent{UserID: id, AdminID: adminID, Reason: RankReasonGrant, Delta: delta, Note: note})
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "GrantRank")
+		return
+	}
+	err = tx.Commit().Error
+	if err == nil {
+		user, err = FindUser(db, id)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "GrantRank")
+		return
+	}
+	return
+}
+
+// FindRankEvents lists the rank events of the user id, newest first.
+func FindRankEvents(db *gorm.DB, id uint, offsetID uint) (events []RankEvent, err error) {
+	db = db.Where("user_id = ?", id)
+	if offsetID != 0 {
+		db = db.Where("id < ?", offsetID)
+	}
+	err = db.Order("id desc").Limit(20).Find(&events).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindRankEvents")
+		return
+	}
+	return
+}
+
+// FillRankEvents records the rank events of the comments that count for
+// their user but have none, those written before the ledger existed. Their
+// Delta is 0 until RecomputeRanks applies the rules to them.
+func FillRankEvents(db *gorm.DB) (err error) {
+	for reason, cond := range map[string]string{
+		RankReasonApprovedComment: "status = 'approved' AND removed_at IS NULL",
+		RankReasonSpamComment:     "status = 'spam'",
+	} {
+		err = db.Exec("INSERT INTO rank_events (user_id, comment_id, reason, sign, delta, created_at) "+
+			"SELECT user_id, id, ?, 1, 0, created_at FROM comments WHERE "+cond+" AND NOT EXISTS "+
+			"(SELECT 1 FROM rank_events WHERE rank_events.comment_id = comments.id AND rank_events.reason = ?)",
+			reason, reason).Error
+		if err != nil {
+			err = errors.Wrap(err, "FillRankEvents")
+			return
+		}
+	}
+	return
+}
+
+// RecomputeRanks replays the ledger under rules: the events following a rule
+// take its current value, and every Rank becomes the sum of its events. It
+// returns how many ranks changed.
+func RecomputeRanks(db *gorm.DB, rules RankConfig) (count int, err error) {
+	err = FillRankEvents(db)
+	if err != nil {
+		err = errors.Wrap(err, "RecomputeRanks")
+		return
+	}
+	const sum = "COALESCE((SELECT SUM(delta) FROM rank_events WHERE rank_events.user_id = users.id), 0)"
+	tx := db.Begin()
+	for _, reason := range []string{RankReasonApprovedComment, RankReasonSpamComment} {
+		if err == nil {
+			err = tx.Model(&RankEvent{}).Where("reason = ?", reason).
+				UpdateColumn("delta", gorm.Expr("sign * ?", ruleDelta(rules, reason))).Error
+		}
+	}
+	if err == nil {
+		err = tx.Model(&User{}).Where("rank <> " + sum).Count(&count).Error
+	}
+	if err == nil {
+		err = tx.Model(&User{}).UpdateColumn("rank", gorm.Expr(sum)).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "RecomputeRanks")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		err = errors.Wrap(err, "RecomputeRanks")
+		return
+	}
+	return
+}
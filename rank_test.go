@@ -0,0 +1,107 @@
+package kotori
+
+import (
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+var testRankRules = RankConfig{APPROVED_COMMENT: 2, SPAM_COMMENT: 5}
+
+// checkRankLedger fails t unless the Rank of the user id is want and the sum
+// of its rank events.
+func checkRankLedger(t *testing.T, db *gorm.DB, id uint, want int64) {
+	t.Helper()
+	var user User
+	if err := db.First(&user, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	var sum struct{ Total int64 }
+	err := db.Raw("SELECT COALESCE(SUM(delta), 0) AS total FROM rank_events WHERE user_id = ?", id).Scan(&sum).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Rank != sum.Total {
+		t.Errorf("rank %d, but events sum to %d", user.Rank, sum.Total)
+	}
+	if user.Rank != want {
+		t.Errorf("got rank %d, want %d", user.Rank, want)
+	}
+}
+
+func TestCommentRank(t *testing.T) {
+	moderate := func(status string) func(*gorm.DB, uint) error {
+		return func(db *gorm.DB, id uint) error {
+			_, err := ModerateComments(db, []uint{id}, status, testRankRules)
+			return err
+		}
+	}
+	remove := func(db *gorm.DB, id uint) error { return RemoveComment(db, id, false, testRankRules) }
+	restore := func(db *gorm.DB, id uint) error { return RestoreRemovedComment(db, id, testRankRules) }
+	recompute := func(rules RankConfig) func(*gorm.DB, uint) error {
+		return func(db *gorm.DB, id uint) error {
+			_, err := RecomputeRanks(db, rules)
+			return err
+		}
+	}
+	cases := []struct {
+		name   string
+		status string
+		steps  []func(*gorm.DB, uint) error
+		want   int64
+	}{
+		{"approved", CommentStatusApproved, nil, 2},
+		{"pending", CommentStatusPending, nil, 0},
+		{"approve reject approve", CommentStatusPending,
+			[]func(*gorm.DB, uint) error{moderate(CommentStatusApproved), moderate(CommentStatusRejected),
+				moderate(CommentStatusApproved)}, 2},
+		{"approve reject", CommentStatusPending,
+			[]func(*gorm.DB, uint) error{moderate(CommentStatusApproved), moderate(CommentStatusRejected)}, 0},
+		{"remove", CommentStatusApproved, []func(*gorm.DB, uint) error{remove}, 0},
+		{"remove restore", CommentStatusApproved, []func(*gorm.DB, uint) error{remove, restore}, 2},
+		{"spam", CommentStatusApproved, []func(*gorm.DB, uint) error{moderate(CommentStatusSpam)}, -5},
+		{"spam removed", CommentStatusApproved,
+			[]func(*gorm.DB, uint) error{moderate(CommentStatusSpam), remove}, -5},
+		{"spam approve", CommentStatusPending,
+			[]func(*gorm.DB, uint) error{moderate(CommentStatusSpam), moderate(CommentStatusApproved)}, 2},
+		{"recompute", CommentStatusApproved, []func(*gorm.DB, uint) error{recompute(testRankRules)}, 2},
+		{"recompute after a rule change", CommentStatusApproved,
+			[]func(*gorm.DB, uint) error{recompute(RankConfig{APPROVED_COMMENT: 3, SPAM_COMMENT: 5})}, 3},
+		{"recompute spam after a rule change", CommentStatusApproved,
+			[]func(*gorm.DB, uint) error{moderate(CommentStatusSpam), recompute(RankConfig{APPROVED_COMMENT: 3})}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := openTestDB(t)
+			comment, err := StoreComment(db, Comment{CommentZoneID: 1, Content: "comment", Status: c.status,
+				User: User{Name: "user", Email: "user@example.com"}}, ModerationConfig{}, testRankRules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range c.steps {
+				if err := step(db, comment.ID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			checkRankLedger(t, db, comment.UserID, c.want)
+		})
+	}
+}
+
+func TestRecomputeRanksFillsLegacyComments(t *testing.T) {
+	db := openTestDB(t)
+	user := User{Name: "user", Email: "user@example.com", Rank: 7}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	storeTestComment(t, db, Comment{UserID: user.ID, Content: "approved"})
+	storeTestComment(t, db, Comment{UserID: user.ID, Content: "spam", Status: CommentStatusSpam})
+	count, err := RecomputeRanks(db, testRankRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("got %d changed ranks, want 1", count)
+	}
+	checkRankLedger(t, db, user.ID, -3)
+}
@@ -0,0 +1,234 @@
+package kotori
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/yanzay/log"
+)
+
+const (
+	RateLimitKeyIP      = "ip"
+	RateLimitKeyEmail   = "email"
+	RateLimitKeySession = "session"
+)
+
+const (
+	RateLimitStoreMemory = "memory"
+	RateLimitStoreSQLite = "sqlite"
+)
+
+// RateLimitStore keeps the token buckets of a RateLimiter.
+type RateLimitStore interface {
+	// Take removes a token from the bucket key, which holds up to burst
+	// tokens and refills at rate tokens per second. When the bucket is
+	// empty it returns how long until a token is available.
+	Take(key string, rate float64, burst int, now time.Time) (ok bool, wait time.Duration, err error)
+}
+
+// refillBucket returns the tokens of a bucket that had tokens at last, and
+// whether one can be taken from it now.
+func refillBucket(tokens float64, last time.Time, now time.Time, rate float64, burst int) (float64, bool, time.Duration) {
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		tokens = math.Min(float64(burst), tokens+elapsed*rate)
+	}
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	return tokens, false, time.Duration((1 - tokens) / rate * float64(time.Second))
+}
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// MemoryRateLimitStore keeps buckets in memory, so they are reset when the
+// server restarts.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	swept   time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*memoryBucket)}
+}
+
+// rateLimitBucketIdle is how long a bucket is kept without being used.
+// Buckets refill long before that with any sensible rate.
+const rateLimitBucketIdle = time.Hour
+
+func (s *MemoryRateLimitStore) Take(key string, rate float64, burst int, now time.Time) (ok bool, wait time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) > rateLimitBucketIdle {
+		for k, b := range s.buckets {
+			if now.Sub(b.last) > rateLimitBucketIdle {
+				delete(s.buckets, k)
+			}
+		}
+		s.swept = now
+	}
+	b := s.buckets[key]
+	if b == nil {
+		b = &memoryBucket{tokens: float64(burst), last: now}
+		s.buckets[key] = b
+	}
+	b.tokens, ok, wait = refillBucket(b.tokens, b.last, now, rate, burst)
+	b.last = now
+	return
+}
+
+// RateLimitBucket is a token bucket stored by SQLiteRateLimitStore.
+type RateLimitBucket struct {
+	Key     string    `gorm:"primary_key"`
+	Tokens  float64   `gorm:"not null"`
+	Checked time.Time `gorm:"not null;index"`
+}
+
+// SQLiteRateLimitStore keeps buckets in the database so that limits survive
+// restarts.
+type SQLiteRateLimitStore struct {
+	db    *gorm.DB
+	mu    sync.Mutex
+	swept time.Time
+}
+
+func NewSQLiteRateLimitStore(db *gorm.DB) *SQLiteRateLimitStore {
+	return &SQLiteRateLimitStore{db: db}
+}
+
+func (s *SQLiteRateLimitStore) Take(key string, rate float64, burst int, now time.Time) (ok bool, wait time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Sub(s.swept) > rateLimitBucketIdle {
+		err = s.db.Delete(RateLimitBucket{}, "checked < ?", now.Add(-rateLimitBucketIdle)).Error
+		s.swept = now
+	}
+	bucket := RateLimitBucket{Key: key, Tokens: float64(burst), Checked: now}
+	if err == nil {
+		err = s.db.Where("key = ?", key).First(&bucket).Error
+		if gorm.IsRecordNotFoundError(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		bucket.Tokens, ok, wait = refillBucket(bucket.Tokens, bucket.Checked, now, rate, burst)
+		bucket.Checked = now
+		err = s.db.Save(&bucket).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "SQLiteRateLimitStore.Take")
+		return
+	}
+	return
+}
+
+// RateLimiter is a negroni middleware throttling the requests matching its
+// rules with token buckets.
+type RateLimiter struct {
+	Rules      []RateLimitRule
+	Store      RateLimitStore
+	TrustProxy bool
+}
+
+// NewRateLimiter returns a limiter applying the rules of cfg, leaving out
+// those that could never let a request through.
+func NewRateLimiter(cfg RateLimitConfig, store RateLimitStore) *RateLimiter {
+	l := &RateLimiter{Store: store, TrustProxy: cfg.TRUST_PROXY}
+	for _, rule := range cfg.RULES {
+		if rule.PER_MINUTE <= 0 || rule.BURST < 1 {
+			log.Warning("Ignoring rate limit of ", rule.METHOD, " ", rule.PATH, ": per_minute and burst must be positive.")
+			continue
+		}
+		l.Rules = append(l.Rules, rule)
+	}
+	return l
+}
+
+func (l *RateLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	now := time.Now()
+	for i, rule := range l.Rules {
+		if !strings.EqualFold(rule.METHOD, req.Method) || !matchRoute(rule.PATH, req.URL.Path) {
+			continue
+		}
+		key := l.key(rule.KEY, req)
+		if key == "" {
+			continue
+		}
+		ok, wait, err := l.Store.Take(strconv.Itoa(i)+":"+rule.KEY+":"+key, rule.PER_MINUTE/60, rule.BURST, now)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			res := map[string]interface{}{
+				"code":   http.StatusTooManyRequests,
+				"result": false,
+				"msg":    "Too many requests, please retry later.",
+			}
+			respondJson(w, res, http.StatusTooManyRequests)
+			return
+		}
+	}
+	next(w, req)
+}
+
+// key identifies the client of req for a rule keyed by kind. It is empty
+// when the request carries no such key, in which case the rule is skipped.
+func (l *RateLimiter) key(kind string, req *http.Request) string {
+	switch kind {
+	case RateLimitKeyIP:
+		return clientIP(req, l.TrustProxy)
+	case RateLimitKeyEmail:
+		req.ParseForm()
+		return strings.ToLower(strings.TrimSpace(req.Form.Get("email")))
+	case RateLimitKeySession:
+		if cookie, err := req.Cookie(sessionCookieName); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// clientIP returns the address of the client, taken from X-Forwarded-For
+// when kotori runs behind a trusted proxy. Only the last entry, appended by
+// that proxy, is taken: the client may have sent the others.
+func clientIP(req *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := req.Header.Values("X-Forwarded-For"); len(forwarded) != 0 {
+			entries := strings.Split(forwarded[len(forwarded)-1], ",")
+			return strings.TrimSpace(entries[len(entries)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// matchRoute reports whether path matches pattern, a route as registered with
+// the router where :name segments match any single segment.
+func matchRoute(pattern string, path string) bool {
+	patterns := strings.Split(strings.Trim(pattern, "/"), "/")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patterns) != len(parts) {
+		return false
+	}
+	for i := range patterns {
+		if !strings.HasPrefix(patterns[i], ":") && patterns[i] != parts[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,278 @@
+package kotori
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// voterCookieName is the cookie identifying anonymous voters.
+const voterCookieName = "kotoriVoter"
+
+// commenterCookieName is the cookie identifying the User a visitor commented
+// as, so that they vote as that User.
+const commenterCookieName = "kotoriCommenter"
+
+// voterCookieLifetime is how long, in seconds, a visitor keeps its votes.
+const voterCookieLifetime = 365 * 24 * 3600
+
+// hotScoreInterval is how much newer, in seconds, a comment has to be to rank
+// as high in the top sort as one with ten times its net votes.
+const hotScoreInterval = 45000
+
+// CommentVote is the up (1) or down (-1) vote of a voter on a comment. Voter
+// is "user:" and the id of a User, or "anon:" and the id of a voter cookie.
+type CommentVote struct {
+	ID        uint      `gorm:"AUTO_INCREMENT" json:"id"`
+	CommentID uint      `gorm:"not null;unique_index:idx_comment_vote" json:"comment_id"`
+	Voter     string    `gorm:"not null;unique_index:idx_comment_vote" json:"voter"`
+	Value     int       `gorm:"not null" json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CommentReaction is an emoji a voter reacted to a comment with, one of the
+// REACTIONS of the comment config.
+type CommentReaction struct {
+	ID        uint      `gorm:"AUTO_INCREMENT" json:"id"`
+	CommentID uint      `gorm:"not null;unique_index:idx_comment_reaction" json:"comment_id"`
+	Voter     string    `gorm:"not null;unique_index:idx_comment_reaction" json:"voter"`
+	Emoji     string    `gorm:"not null;unique_index:idx_comment_reaction" json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func ValidReaction(cfg CommentConfig, emoji string) bool {
+	for _, e := range cfg.REACTIONS {
+		if e == emoji {
+			return true
+		}
+	}
+	return false
+}
+
+// hotScore ranks comments for the top sort by the order of magnitude of
+// their net votes, plus their creation time in units of hotScoreInterval:
+// older comments need ever more votes to stay on top. Unlike a score decaying
+// as time passes, it only changes when votes do.
+func hotScore(net int, createdAt time.Time) float64 {
+	order := math.Log10(math.Max(math.Abs(float64(net)), 1))
+	if net < 0 {
+		order = -order
+	}
+	return order + float64(createdAt.Unix())/hotScoreInterval
+}
+
+// StoreCommentVote records the vote value of voter on the approved comment
+// commentID, 0 withdrawing it, and returns the comment with its new counts.
+func StoreCommentVote(db *gorm.DB, commentID uint, voter string, value int) (comment Comment, err error) {
+	tx := db.Begin()
+	err = tx.Where("id = ? AND status = ? AND removed_at IS NULL", commentID, CommentStatusApproved).First(&comment).Error
+	if err == nil {
+		err = checkCommentZoneUnlocked(tx, comment.CommentZoneID)
+	}
+	var vote CommentVote
+	if err == nil {
+		err = tx.Where("comment_id = ? AND voter = ?", commentID, voter).First(&vote).Error
+		if gorm.IsRecordNotFoundError(err) {
+			err = nil
+		}
+	}
+	if err == nil && vote.Value != value {
+		up, down := voteCounts(value)
+		oldUp, oldDown := voteCounts(vote.Value)
+		switch {
+		case value == 0:
+			err = tx.Delete(&vote).Error
+		case vote.Value == 0:
+			err = tx.Create(&CommentVote{CommentID: commentID, Voter: voter, Value: value}).Error
+		default:
+			err = tx.Model(&vote).UpdateColumn("value", value).Error
+		}
+		if err == nil {
+			err = tx.Model(&comment).UpdateColumns(map[string]interface{}{
+				"upvotes":   gorm.Expr("upvotes + ?", up-oldUp),
+				"downvotes": gorm.Expr("downvotes + ?", down-oldDown),
+			}).Error
+		}
+		if err == nil {
+			err = tx.Where("id = ?", commentID).First(&comment).Error
+		}
+		if err == nil {
+			comment.Score = hotScore(comment.Upvotes-comment.Downvotes, comment.CreatedAt)
+			err = tx.Model(&comment).UpdateColumn("score", comment.Score).Error
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "StoreCommentVote")
+		return
+	}
+	err = tx.Commit().Error
+	if err == nil {
+		comment, err = FindComment(db, commentID)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "StoreCommentVote")
+		return
+	}
+	return
+}
+
+// voteCounts returns the upvotes and the downvotes the vote value counts for.
+func voteCounts(value int) (up int, down int) {
+	if value > 0 {
+		return 1, 0
+	} else if value < 0 {
+		return 0, 1
+	}
+	return 0, 0
+}
+
+// StoreCommentReaction adds the reaction emoji of voter to the approved
+// comment commentID, and returns the comment with its new counts.
+func StoreCommentReaction(db *gorm.DB, commentID uint, voter string, emoji string) (comment Comment, err error) {
+	err = db.Where("id = ? AND status = ? AND removed_at IS NULL", commentID, CommentStatusApproved).First(&comment).Error
+	if err == nil {
+		err = checkCommentZoneUnlocked(db, comment.CommentZoneID)
+	}
+	if err == nil {
+		reaction := CommentReaction{CommentID: commentID, Voter: voter, Emoji: emoji}
+		err = db.Where(reaction).FirstOrCreate(&reaction).Error
+	}
+	if err == nil {
+		comment, err = FindComment(db, commentID)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "StoreCommentReaction")
+		return
+	}
+	return
+}
+
+// RemoveCommentReaction withdraws the reaction emoji of voter from the
+// approved comment commentID, and returns the comment with its new counts.
+func RemoveCommentReaction(db *gorm.DB, commentID uint, voter string, emoji string) (comment Comment, err error) {
+	err = db.Where("id = ? AND status = ? AND removed_at IS NULL", commentID, CommentStatusApproved).First(&comment).Error
+	if err == nil {
+		err = checkCommentZoneUnlocked(db, comment.CommentZoneID)
+	}
+	if err == nil {
+		err = db.Delete(CommentReaction{}, "comment_id = ? AND voter = ? AND emoji = ?", commentID, voter, emoji).Error
+	}
+	if err == nil {
+		comment, err = FindComment(db, commentID)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "RemoveCommentReaction")
+		return
+	}
+	return
+}
+
+// fillReactions sets the Reactions of comments to the number of voters who
+// reacted with each emoji.
+func fillReactions(db *gorm.DB, comments []Comment, ids []uint) (err error) {
+	var counts []struct {
+		CommentID uint
+		Emoji     string
+		Count     int
+	}
+	err = db.Model(&CommentReaction{}).Select("comment_id, emoji, COUNT(*) AS count").
+		Where("comment_id IN (?)", ids).Group("comment_id, emoji").Scan(&counts).Error
+	if err != nil {
+		return
+	}
+	reactions := make(map[uint]map[string]int, len(comments))
+	for _, c := range counts {
+		if reactions[c.CommentID] == nil {
+			reactions[c.CommentID] = make(map[string]int)
+		}
+		reactions[c.CommentID][c.Emoji] = c.Count
+	}
+	for i := range comments {
+		comments[i].Reactions = reactions[comments[i].ID]
+		if comments[i].Reactions == nil {
+			comments[i].Reactions = map[string]int{}
+		}
+	}
+	return
+}
+
+// FillCommentScores sets the Score of the comments created before the top
+// sort existed.
+func FillCommentScores(db *gorm.DB) (err error) {
+	var comments []Comment
+	err = db.Select("id, upvotes, downvotes, created_at").Where("score = 0").Find(&comments).Error
+	for i := 0; err == nil && i < len(comments); i++ {
+		score := hotScore(comments[i].Upvotes-comments[i].Downvotes, comments[i].CreatedAt)
+		err = db.Model(&comments[i]).UpdateColumn("score", score).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "FillCommentScores")
+		return
+	}
+	return
+}
+
+// voterKey identifies who votes with req: the User the visitor commented as,
+// proven by the signed commenter cookie, or else the visitor holding the
+// signed voter cookie, which is set on w when missing. The email of a User is
+// no proof, as anyone can give it.
+func voterKey(w http.ResponseWriter, req *http.Request) (voter string, err error) {
+	if id, ok := signedCookie(req, commenterCookieName, "commenter"); ok {
+		return "user:" + id, nil
+	}
+	if id, ok := signedCookie(req, voterCookieName, "voter"); ok {
+		return "anon:" + id, nil
+	}
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		err = errors.Wrap(err, "voterKey")
+		return
+	}
+	id := hex.EncodeToString(b)
+	setSignedCookie(w, voterCookieName, "voter", id)
+	return "anon:" + id, nil
+}
+
+// setCommenterCookie lets the visitor who commented as user vote and react as
+// user from then on.
+func setCommenterCookie(w http.ResponseWriter, user User) {
+	setSignedCookie(w, commenterCookieName, "commenter", strconv.FormatUint(uint64(user.ID), 10))
+}
+
+// setSignedCookie sets the cookie name to value and its signature for
+// purpose, for voterCookieLifetime.
+func setSignedCookie(w http.ResponseWriter, name string, purpose string, value string) {
+	sameSite, _ := parseSameSite(GlobCfg.SESSION.SAME_SITE)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value + "." + sign(purpose, value),
+		Path:     "/",
+		MaxAge:   voterCookieLifetime,
+		Secure:   GlobCfg.SESSION.SECURE,
+		HttpOnly: true,
+		SameSite: sameSite,
+	})
+}
+
+// signedCookie returns the value of the cookie name of req if its signature
+// for purpose is valid.
+func signedCookie(req *http.Request, name string, purpose string) (value string, ok bool) {
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || !verifySignature(purpose, parts[0], parts[1]) {
+		return
+	}
+	return parts[0], true
+}
@@ -0,0 +1,117 @@
+package kotori
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday/v2"
+)
+
+const (
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+	FormatPlain    = "plain"
+)
+
+// commentPolicy only keeps basic inline formatting, lists, quotes and code,
+// since comments are written by anonymous visitors.
+var commentPolicy = func() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+	p.AllowElements("p", "br", "em", "strong", "del", "code", "pre", "blockquote")
+	p.AllowLists()
+	p.AllowStandardURLs()
+	p.AllowAttrs("href").OnElements("a")
+	p.RequireNoFollowOnLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+	return p
+}()
+
+// postPolicy additionally keeps headings, images, tables, footnotes and the
+// classes of highlighted code, since posts are written by admins.
+var postPolicy = func() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowTables()
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^[\w\- ]+$`)).OnElements("pre", "code", "span")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^footnote[\w\-]*$`)).OnElements("a", "sup", "div")
+	p.AllowAttrs("id").Matching(regexp.MustCompile(`^fn(ref)?:[\w\-]+$`)).OnElements("sup", "li")
+	return p
+}()
+
+// ValidFormat reports whether format is a content format kotori can render.
+func ValidFormat(format string) bool {
+	return format == FormatMarkdown || format == FormatHTML || format == FormatPlain
+}
+
+// RenderPost renders the source of a post to sanitized HTML.
+func RenderPost(format string, source string) string {
+	if format == FormatMarkdown {
+		renderer := &highlightRenderer{blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+			Flags: blackfriday.CommonHTMLFlags | blackfriday.FootnoteReturnLinks,
+		})}
+		source = string(blackfriday.Run([]byte(source), blackfriday.WithRenderer(renderer),
+			blackfriday.WithExtensions(blackfriday.CommonExtensions|blackfriday.Footnotes)))
+	}
+	return render(format, source, postPolicy)
+}
+
+// RenderComment renders the source of a comment to sanitized HTML.
+func RenderComment(format string, source string) string {
+	if format == FormatMarkdown {
+		source = string(blackfriday.Run([]byte(source),
+			blackfriday.WithExtensions(blackfriday.CommonExtensions&^blackfriday.Tables|blackfriday.HardLineBreak)))
+	}
+	return render(format, source, commentPolicy)
+}
+
+func render(format string, source string, policy *bluemonday.Policy) string {
+	if format == FormatPlain {
+		var buf bytes.Buffer
+		for _, para := range strings.Split(strings.Replace(source, "\r\n", "\n", -1), "\n\n") {
+			if para = strings.TrimSpace(para); para != "" {
+				buf.WriteString("<p>")
+				buf.WriteString(strings.Replace(html.EscapeString(para), "\n", "<br>", -1))
+				buf.WriteString("</p>\n")
+			}
+		}
+		return buf.String()
+	}
+	return policy.Sanitize(source)
+}
+
+// highlightRenderer highlights fenced code blocks with chroma, emitting CSS
+// classes so that the front-end picks the colour scheme.
+type highlightRenderer struct {
+	*blackfriday.HTMLRenderer
+}
+
+func (r *highlightRenderer) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	if node.Type != blackfriday.CodeBlock {
+		return r.HTMLRenderer.RenderNode(w, node, entering)
+	}
+	lang := strings.Fields(string(node.Info))
+	var lexer chroma.Lexer
+	if len(lang) != 0 {
+		lexer = lexers.Get(lang[0])
+	}
+	if lexer == nil {
+		return r.HTMLRenderer.RenderNode(w, node, entering)
+	}
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, string(node.Literal))
+	if err == nil {
+		var buf bytes.Buffer
+		err = chromahtml.New(chromahtml.WithClasses(true)).Format(&buf, styles.Fallback, iterator)
+		if err == nil {
+			w.Write(buf.Bytes())
+			return blackfriday.GoToNext
+		}
+	}
+	return r.HTMLRenderer.RenderNode(w, node, entering)
+}
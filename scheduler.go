@@ -0,0 +1,76 @@
+package kotori
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/yanzay/log"
+)
+
+// schedulerWake is signalled whenever a post may have been (re)scheduled so
+// the scheduler can recompute its next deadline.
+var schedulerWake = make(chan struct{}, 1)
+
+// schedulerMaxSleep bounds how long the scheduler waits between checks, in
+// case a post was scheduled without going through the API.
+const schedulerMaxSleep = time.Minute
+
+func wakeScheduler() {
+	select {
+	case schedulerWake <- struct{}{}:
+	default:
+	}
+}
+
+// commentPurgeInterval is how often removed comments past their retention
+// period are looked for.
+const commentPurgeInterval = time.Hour
+
+// runScheduler publishes scheduled posts as soon as their publication time is
+// reached. It returns when stop is closed.
+func runScheduler(db *gorm.DB, stop <-chan struct{}) {
+	for {
+		count, err := PublishScheduledPosts(db, time.Now())
+		if err != nil {
+			log.Error(err)
+		} else if count != 0 {
+			log.Infof("Published %d scheduled post(s).", count)
+		}
+		sleep := schedulerMaxSleep
+		next, err := NextScheduledPost(db)
+		if err != nil {
+			log.Error(err)
+		} else if next != nil && time.Until(*next) < sleep {
+			sleep = time.Until(*next)
+		}
+		timer := time.NewTimer(sleep)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-schedulerWake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// runCommentPurge deletes for good the comments removed more than retention
+// ago, every commentPurgeInterval. It returns when stop is closed.
+func runCommentPurge(db *gorm.DB, retention time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(commentPurgeInterval)
+	defer ticker.Stop()
+	for {
+		count, err := PurgeRemovedComments(db, time.Now().Add(-retention))
+		if err != nil {
+			log.Error(err)
+		} else if count != 0 {
+			log.Infof("Purged %d removed comment(s).", count)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
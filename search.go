@@ -0,0 +1,297 @@
+package kotori
+
+import (
+	"html"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/yanzay/log"
+)
+
+// Full-text search is backed by an SQLite FTS5 table. The sqlite3 driver only
+// ships FTS5 when built with the sqlite_fts5 tag; without it search is
+// disabled and SearchAvailable stays false.
+
+const (
+	SearchTypePost    = "post"
+	SearchTypeIndex   = "index"
+	SearchTypeComment = "comment"
+)
+
+// cjkSeparator is placed between CJK characters before they reach the FTS5
+// unicode61 tokenizer, which would otherwise treat a whole run of CJK text as
+// a single token. It is a format character, so the tokenizer splits on it,
+// and it is invisible, so it is simply dropped from snippets.
+const cjkSeparator = "\u200b"
+
+// Matches are delimited with control characters by FTS5 and turned into
+// <mark> elements only after the surrounding text has been escaped.
+const (
+	highlightOpen  = "\x02"
+	highlightClose = "\x03"
+)
+
+var highlightReplacer = strings.NewReplacer(cjkSeparator, "", highlightOpen, "<mark>", highlightClose, "</mark>")
+
+var ErrSearchUnavailable = errors.New("full-text search is not available")
+
+var SearchAvailable bool
+
+type SearchResult struct {
+	Type          string  `json:"type"`
+	RefID         uint    `json:"ref_id"`
+	Title         string  `json:"title"`
+	Snippet       string  `json:"snippet"`
+	Slug          string  `json:"slug,omitempty"`
+	CommentZoneID uint    `json:"comment_zone_id,omitempty"`
+	Score         float64 `json:"-"`
+	RowID         int64   `json:"-"`
+}
+
+// SearchCursor points right after a search result. Results are ordered by
+// score, ties broken by row id.
+type SearchCursor struct {
+	Score float64
+	RowID int64
+}
+
+func (c SearchCursor) String() string {
+	return strconv.FormatFloat(c.Score, 'g', -1, 64) + "_" + strconv.FormatInt(c.RowID, 10)
+}
+
+func ParseSearchCursor(s string) (c SearchCursor, err error) {
+	i := strings.LastIndex(s, "_")
+	if i < 0 {
+		err = errors.New("malformed search cursor")
+		return
+	}
+	c.Score, err = strconv.ParseFloat(s[:i], 64)
+	if err == nil {
+		c.RowID, err = strconv.ParseInt(s[i+1:], 10, 64)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "ParseSearchCursor")
+		return
+	}
+	return
+}
+
+// migrateSearch creates the search table if the driver supports FTS5.
+func migrateSearch(db *gorm.DB) {
+	err := db.Exec("CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts5(" +
+		"type UNINDEXED, ref_id UNINDEXED, title, body, tokenize = 'unicode61')").Error
+	if err != nil {
+		log.Warning("Full-text search disabled: ", err)
+		SearchAvailable = false
+		return
+	}
+	SearchAvailable = true
+}
+
+// segmentCJK separates every CJK character from its neighbours so that each
+// one is indexed as a token of its own.
+func segmentCJK(text string) string {
+	var b strings.Builder
+	prevCJK := false
+	for _, r := range text {
+		cjk := isCJK(r)
+		if (cjk || prevCJK) && b.Len() != 0 {
+			b.WriteString(cjkSeparator)
+		}
+		b.WriteRune(r)
+		prevCJK = cjk
+	}
+	return b.String()
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// BuildSearchQuery turns user input into an FTS5 query. Double quoted parts
+// are matched as phrases, a trailing * makes a word or phrase a prefix match,
+// and all parts must match. Everything else is quoted, so the input cannot
+// use FTS5 operators.
+func BuildSearchQuery(input string) string {
+	var terms []string
+	for len(input) != 0 {
+		input = strings.TrimLeftFunc(input, unicode.IsSpace)
+		if input == "" {
+			break
+		}
+		var term string
+		if input[0] == '"' {
+			end := strings.IndexByte(input[1:], '"')
+			if end < 0 {
+				term, input = input[1:], ""
+			} else {
+				term, input = input[1:end+1], input[end+2:]
+			}
+		} else {
+			end := strings.IndexFunc(input, unicode.IsSpace)
+			if end < 0 {
+				end = len(input)
+			}
+			term, input = input[:end], input[end:]
+		}
+		prefix := false
+		if strings.HasPrefix(input, "*") {
+			prefix, input = true, input[1:]
+		} else if strings.HasSuffix(term, "*") {
+			prefix, term = true, strings.TrimRight(term, "*")
+		}
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		term = `"` + strings.Replace(segmentCJK(term), `"`, `""`, -1) + `"`
+		if prefix {
+			term += " *"
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+func updateSearchIndex(db *gorm.DB, typ string, id uint, title string, body string) (err error) {
+	if !SearchAvailable {
+		return
+	}
+	err = removeFromSearchIndex(db, typ, id)
+	if err != nil {
+		return
+	}
+	err = db.Exec("INSERT INTO search_index (type, ref_id, title, body) VALUES (?, ?, ?, ?)",
+		typ, id, segmentCJK(title), segmentCJK(body)).Error
+	if err != nil {
+		err = errors.Wrap(err, "updateSearchIndex")
+		return
+	}
+	return
+}
+
+func removeFromSearchIndex(db *gorm.DB, typ string, id uint) (err error) {
+	if !SearchAvailable {
+		return
+	}
+	err = db.Exec("DELETE FROM search_index WHERE type = ? AND ref_id = ?", typ, id).Error
+	if err != nil {
+		err = errors.Wrap(err, "removeFromSearchIndex")
+		return
+	}
+	return
+}
+
+func indexPost(db *gorm.DB, id uint) (err error) {
+	if !SearchAvailable {
+		return
+	}
+	var post Post
+	err = db.Where("id = ?", id).First(&post).Error
+	if err != nil {
+		err = errors.Wrap(err, "indexPost")
+		return
+	}
+	return updateSearchIndex(db, SearchTypePost, post.ID, post.Title, post.Content)
+}
+
+// SearchFilter narrows down Search. Types restricts the kinds of records
+// returned; All includes records that are not public, such as drafts and
+// comments awaiting moderation.
+type SearchFilter struct {
+	Types []string
+	All   bool
+}
+
+// Search runs the user query input and returns up to limit results after cursor.
+func Search(db *gorm.DB, input string, filter SearchFilter, cursor *SearchCursor, limit int) (results []SearchResult, err error) {
+	if !SearchAvailable {
+		err = ErrSearchUnavailable
+		return
+	}
+	query := BuildSearchQuery(input)
+	if query == "" {
+		return
+	}
+	sql := "SELECT * FROM (SELECT search_index.type AS type, search_index.ref_id AS ref_id, " +
+		"highlight(search_index, 2, ?, ?) AS title, snippet(search_index, 3, ?, ?, '…', 16) AS snippet, " +
+		"bm25(search_index, 0.0, 0.0, 10.0, 1.0) AS score, search_index.rowid AS row_id, " +
+		"posts.slug AS slug, comments.comment_zone_id AS comment_zone_id " +
+		"FROM search_index " +
+		"LEFT JOIN posts ON search_index.type = 'post' AND posts.id = search_index.ref_id " +
+		"LEFT JOIN comments ON search_index.type = 'comment' AND comments.id = search_index.ref_id " +
+		"WHERE search_index MATCH ?"
+	args := []interface{}{highlightOpen, highlightClose, highlightOpen, highlightClose, query}
+	if !filter.All {
+		sql += " AND (search_index.type <> 'post' OR posts.status = ?)" +
+			" AND (search_index.type <> 'comment' OR (comments.status = ? AND comments.removed_at IS NULL))"
+		args = append(args, PostStatusPublished, CommentStatusApproved)
+	}
+	if len(filter.Types) != 0 {
+		sql += " AND search_index.type IN (?)"
+		args = append(args, filter.Types)
+	}
+	sql += ")"
+	if cursor != nil {
+		sql += " WHERE score > ? OR (score = ? AND row_id > ?)"
+		args = append(args, cursor.Score, cursor.Score, cursor.RowID)
+	}
+	sql += " ORDER BY score, row_id LIMIT ?"
+	args = append(args, limit)
+	err = db.Raw(sql, args...).Scan(&results).Error
+	if err != nil {
+		err = errors.Wrap(err, "Search")
+		return
+	}
+	for i := range results {
+		results[i].Title = highlightReplacer.Replace(html.EscapeString(results[i].Title))
+		results[i].Snippet = highlightReplacer.Replace(html.EscapeString(results[i].Snippet))
+	}
+	return
+}
+
+// RebuildSearchIndex discards the search index and fills it again from the
+// posts, indexes and comments tables, leaving out removed comments.
+func RebuildSearchIndex(db *gorm.DB) (err error) {
+	if !SearchAvailable {
+		err = ErrSearchUnavailable
+		return
+	}
+	tx := db.Begin()
+	err = tx.Exec("DELETE FROM search_index").Error
+	var posts []Post
+	if err == nil {
+		err = tx.Find(&posts).Error
+	}
+	for i := 0; err == nil && i < len(posts); i++ {
+		err = updateSearchIndex(tx, SearchTypePost, posts[i].ID, posts[i].Title, posts[i].Content)
+	}
+	var indexes []Index
+	if err == nil {
+		err = tx.Find(&indexes).Error
+	}
+	for i := 0; err == nil && i < len(indexes); i++ {
+		err = updateSearchIndex(tx, SearchTypeIndex, indexes[i].ID, indexes[i].Title, indexes[i].Attr)
+	}
+	var comments []Comment
+	if err == nil {
+		err = tx.Where("removed_at IS NULL").Find(&comments).Error
+	}
+	for i := 0; err == nil && i < len(comments); i++ {
+		err = updateSearchIndex(tx, SearchTypeComment, comments[i].ID, "", comments[i].Content)
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "RebuildSearchIndex")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		err = errors.Wrap(err, "RebuildSearchIndex")
+		return
+	}
+	return
+}
@@ -0,0 +1,272 @@
+package kotori
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/astaxie/beego/session"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/rs/cors"
+	"github.com/urfave/negroni"
+	"github.com/yanzay/log"
+)
+
+// Handlers reach the database and the session manager through these package
+// level variables, which are set by NewServer. Only one Server can be active
+// in a process at a time.
+var db *gorm.DB
+var globalSessions *session.Manager
+var startTime time.Time
+var notifier *Notifier
+var spamFilter *SpamFilter
+
+// Server bundles everything needed to serve the kotori API. Library users may
+// register additional routes on Router or mount the Server in their own mux.
+type Server struct {
+	Config      Config
+	DB          *gorm.DB
+	Sessions    *session.Manager
+	Router      *httprouter.Router
+	Negroni     *negroni.Negroni
+	Notifier    *Notifier
+	SpamFilter  *SpamFilter
+	RateLimiter *RateLimiter
+
+	stop chan struct{}
+	mail *MailQueue
+}
+
+// NewServer opens and migrates the database named in cfg, wires up sessions
+// and routes, and starts the post scheduler and the mail queue.
+func NewServer(cfg Config) (s *Server, err error) {
+	if cfg.SECRET == "" {
+		cfg.SECRET, err = RandomSecret()
+		if err != nil {
+			return
+		}
+		log.Warning("No secret configured, links and tokens will be invalidated on restart.")
+	}
+	s = &Server{Config: cfg, stop: make(chan struct{})}
+	s.DB, err = OpenDatabase(cfg)
+	if err != nil {
+		return
+	}
+	err = Migrate(s.DB)
+	if err != nil {
+		s.DB.Close()
+		return
+	}
+	imported, err := ImportConfigAdmins(s.DB, cfg.ADMIN)
+	if err != nil {
+		s.DB.Close()
+		return
+	}
+	if imported > 0 {
+		log.Warning("Imported ", imported, " admins of the config file as owners, their [[admin]] entries can now be removed.")
+	}
+	for _, admin := range cfg.ADMIN {
+		if !IsPasswordHash(admin.Password) {
+			log.Warning("Admin ", admin.Username, " of the config file has a plaintext password, remove its [[admin]] entry.")
+		}
+	}
+	admins, err := FindAdmins(s.DB)
+	if err != nil {
+		s.DB.Close()
+		return
+	}
+	for _, admin := range admins {
+		if !IsPasswordHash(admin.Password) {
+			log.Warning("Admin ", admin.Username, " has a plaintext password, run `kotori admin passwd ", admin.Username, "` to hash it.")
+		}
+	}
+	s.Sessions, err = NewSessionManager(cfg.SESSION, s.DB)
+	if err != nil {
+		s.DB.Close()
+		return
+	}
+	go s.Sessions.GC()
+
+	if cfg.MAIL.ENABLED {
+		s.mail = NewMailQueue(SMTPMailer{
+			Addr:     cfg.MAIL.SMTP_ADDR,
+			Username: cfg.MAIL.USERNAME,
+			Password: cfg.MAIL.PASSWORD,
+			From:     cfg.MAIL.FROM,
+		}, cfg.MAIL.RETRIES)
+		s.Notifier, err = NewNotifier(s.mail, cfg)
+		if err != nil {
+			s.DB.Close()
+			return
+		}
+		go s.mail.Run()
+	}
+
+	if cfg.SPAM.ENABLED {
+		s.SpamFilter = NewSpamFilter(cfg.SPAM)
+	}
+
+	s.Router = httprouter.New()
+	s.registerRoutes()
+
+	c := cors.New(cors.Options{
+		AllowedOrigins:   cfg.ALLOW_ORIGIN,
+		AllowedMethods:   []string{"GET", "POST", "OPTIONS", "PUT", "DELETE"},
+		AllowCredentials: true,
+		AllowedHeaders:   []string{"X-Query-By", "If-None-Match", "If-Modified-Since", "Authorization"},
+		ExposedHeaders:   []string{"ETag", "Last-Modified", "Retry-After"},
+	})
+	s.Negroni = negroni.New()
+	s.Negroni.Use(c)
+	if cfg.RATE_LIMIT.ENABLED {
+		var store RateLimitStore = NewMemoryRateLimitStore()
+		if cfg.RATE_LIMIT.STORE == RateLimitStoreSQLite {
+			store = NewSQLiteRateLimitStore(s.DB)
+		}
+		s.RateLimiter = NewRateLimiter(cfg.RATE_LIMIT, store)
+		s.Negroni.Use(s.RateLimiter)
+	}
+	s.Negroni.UseHandler(s.Router)
+
+	GlobCfg = cfg
+	db = s.DB
+	globalSessions = s.Sessions
+	notifier = s.Notifier
+	spamFilter = s.SpamFilter
+	startTime = time.Now()
+
+	go runScheduler(s.DB, s.stop)
+	if cfg.COMMENT.RETENTION_DAYS > 0 {
+		go runCommentPurge(s.DB, time.Duration(cfg.COMMENT.RETENTION_DAYS)*24*time.Hour, s.stop)
+	}
+	return
+}
+
+func OpenDatabase(cfg Config) (database *gorm.DB, err error) {
+	database, err = gorm.Open("sqlite3", cfg.DATABASE)
+	if err != nil {
+		err = errors.Wrap(err, "OpenDatabase")
+		return
+	}
+	return
+}
+
+func Migrate(db *gorm.DB) (err error) {
+	err = db.AutoMigrate(&Index{}, &User{}, &Comment{}, &Post{}, &PostSlug{}, &PostRevision{}, &Tag{}, &Category{},
+		&SpamScore{}, &SpamToken{}, &RateLimitBucket{},
+		&StoredSession{}, &AdminSession{}, &APIToken{}, &Admin{}, &CommentVote{}, &CommentReaction{},
+		&CommentZone{}, &CommentRevision{}, &RankEvent{}).Error
+	if err != nil {
+		err = errors.Wrap(err, "Migrate")
+		return
+	}
+	err = FillPostSlugs(db)
+	if err == nil {
+		err = FillCommentZones(db)
+	}
+	if err == nil {
+		err = FillRankEvents(db)
+	}
+	if err == nil {
+		err = FillRemovalIDs(db)
+	}
+	if err != nil {
+		return
+	}
+	migrateSearch(db)
+	err = FillContentHTML(db)
+	if err != nil {
+		return
+	}
+	return FillCommentScores(db)
+}
+
+func (s *Server) registerRoutes() {
+	mux := s.Router
+	mux.GET("/v2", Pong)
+	mux.GET("/v2/status", Status)
+	mux.GET("/v2/comment", ListComment)
+	mux.POST("/v2/comment", CreateComment)
+	mux.PUT("/v2/comment/:id", EditComment)
+	mux.DELETE("/v2/comment/:id", DeleteComment)
+	mux.POST("/v2/comment/:id/restore", RestoreComment)
+	mux.GET("/v2/comment/:id/revision", ListCommentRevision)
+	mux.PUT("/v2/comment/:id/vote", VoteComment)
+	mux.POST("/v2/comment/:id/reaction", CreateReaction)
+	mux.DELETE("/v2/comment/:id/reaction", DeleteReaction)
+	mux.GET("/v2/thread", ListThread)
+	mux.GET("/v2/comment_zone/:id", GetCommentZone)
+	mux.POST("/v2/comment_zone", CreateCommentZone)
+	mux.PUT("/v2/comment_zone/:id", EditCommentZone)
+	mux.GET("/v2/moderation/comment", ListModerationQueue)
+	mux.PUT("/v2/moderation/comment", ModerateComment)
+	mux.GET("/v2/unsubscribe", ConfirmUnsubscribe)
+	mux.POST("/v2/unsubscribe", Unsubscribe)
+	mux.POST("/v2/auth", Login)
+	mux.DELETE("/v2/auth", Logout)
+	mux.GET("/v2/session", ListSession)
+	mux.DELETE("/v2/session/:id", RevokeSession)
+	mux.GET("/v2/token", ListToken)
+	mux.POST("/v2/token", CreateToken)
+	mux.DELETE("/v2/token/:id", DeleteToken)
+	mux.GET("/v2/admin", ListAdmin)
+	mux.POST("/v2/admin", CreateAdmin)
+	mux.PUT("/v2/admin/:id", EditAdmin)
+	mux.DELETE("/v2/admin/:id", DeleteAdmin)
+	mux.PUT("/v2/user/:id", EditUserSetHonor)
+	mux.GET("/v2/user/:id/rank_event", ListUserRankEvent)
+	mux.POST("/v2/user/:id/rank_event", GrantUserRank)
+	mux.GET("/v2/index", ListIndex)
+	mux.GET("/v2/index/:id", GetIndex)
+	mux.POST("/v2/index", CreateIndex)
+	mux.PUT("/v2/index/:id", EditIndex)
+	mux.DELETE("/v2/index/:id", DeleteIndex)
+	mux.GET("/v2/post", ListPost)
+	mux.GET("/v2/post/:id", GetPost)
+	mux.POST("/v2/post", CreatePost)
+	mux.PUT("/v2/post/:id", EditPost)
+	mux.DELETE("/v2/post/:id", DeletePost)
+	mux.GET("/v2/post/:id/revision", ListPostRevision)
+	mux.GET("/v2/post/:id/revision/:rev", GetPostRevision)
+	mux.POST("/v2/post/:id/revision/:rev/restore", RestorePost)
+	mux.GET("/v2/post/:id/diff", DiffPost)
+	mux.GET("/v2/search", SearchAll)
+	mux.GET("/v2/feed/:name", GetFeed)
+	mux.GET("/v2/tag", ListTag)
+	mux.PUT("/v2/tag/:id", EditTag)
+	mux.POST("/v2/tag/:id/merge", MergeTagInto)
+	mux.DELETE("/v2/tag/:id", DeleteTag)
+	mux.GET("/v2/category", ListCategory)
+	mux.PUT("/v2/category/:id", EditCategory)
+	mux.DELETE("/v2/category/:id", DeleteCategory)
+}
+
+// Migrate brings the database of s up to date. NewServer already does so, but
+// calling it again is harmless.
+func (s *Server) Migrate() error {
+	return Migrate(s.DB)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// beego only marks the session cookie Secure on requests it sees as
+	// HTTPS, which they are not behind a TLS terminating proxy.
+	if s.Config.SESSION.SECURE && req.URL.Scheme == "" {
+		req.URL.Scheme = "https"
+	}
+	s.Negroni.ServeHTTP(w, req)
+}
+
+func (s *Server) ListenAndServe() error {
+	return http.ListenAndServe(":"+strconv.FormatInt(s.Config.PORT, 10), s)
+}
+
+func (s *Server) Close() error {
+	close(s.stop)
+	if s.mail != nil {
+		s.mail.Close()
+	}
+	return s.DB.Close()
+}
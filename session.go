@@ -0,0 +1,285 @@
+package kotori
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/astaxie/beego/session"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const (
+	SessionProviderMemory = "memory"
+	SessionProviderFile   = "file"
+	SessionProviderSQLite = "sqlite"
+)
+
+// sessionCookieName is the cookie holding the session id.
+const sessionCookieName = "kotoriCoreSession"
+
+// StoredSession is a session kept by the sqlite session provider.
+type StoredSession struct {
+	ID        string    `gorm:"primary_key"`
+	Data      []byte    `gorm:"type:blob"`
+	UpdatedAt time.Time `gorm:"index"`
+}
+
+// AdminSession records a session an admin logged in with, so that admins can
+// review and revoke them whatever the session provider.
+type AdminSession struct {
+	ID        uint      `gorm:"AUTO_INCREMENT" json:"id"`
+	SID       string    `gorm:"column:sid;not null;unique_index" json:"-"`
+	Username  string    `json:"username"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Current   bool      `gorm:"-" json:"current"`
+}
+
+// sqliteSessions is registered with beego as the sqlite provider. Its
+// database is set by NewServer.
+var sqliteSessions = &sqliteSessionProvider{}
+
+func init() {
+	session.Register(SessionProviderSQLite, sqliteSessions)
+}
+
+// parseSameSite returns the SameSite attribute named mode, the default one
+// when mode is empty.
+func parseSameSite(mode string) (sameSite http.SameSite, err error) {
+	switch strings.ToLower(mode) {
+	case "":
+	case "lax":
+		sameSite = http.SameSiteLaxMode
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	default:
+		err = errors.New("unknown SameSite mode " + mode)
+	}
+	return
+}
+
+// NewSessionManager creates the session manager described by cfg, storing
+// sessions in db when the sqlite provider is chosen.
+func NewSessionManager(cfg SessionConfig, db *gorm.DB) (manager *session.Manager, err error) {
+	managerCfg := &session.ManagerConfig{
+		CookieName:      sessionCookieName,
+		EnableSetCookie: true,
+		Gclifetime:      cfg.LIFETIME,
+		Maxlifetime:     cfg.LIFETIME,
+		DisableHTTPOnly: !cfg.HTTP_ONLY,
+		Secure:          cfg.SECURE,
+	}
+	managerCfg.CookieSameSite, err = parseSameSite(cfg.SAME_SITE)
+	provider := cfg.PROVIDER
+	switch provider {
+	case SessionProviderMemory:
+	case SessionProviderFile:
+		managerCfg.ProviderConfig = cfg.PATH
+	case SessionProviderSQLite:
+		sqliteSessions.db = db
+	default:
+		err = errors.New("unknown session provider " + provider)
+	}
+	if err == nil {
+		manager, err = session.NewManager(provider, managerCfg)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "NewSessionManager")
+		return
+	}
+	return
+}
+
+type sqliteSessionProvider struct {
+	db          *gorm.DB
+	maxlifetime int64
+}
+
+func (p *sqliteSessionProvider) SessionInit(maxlifetime int64, config string) error {
+	p.maxlifetime = maxlifetime
+	return nil
+}
+
+func (p *sqliteSessionProvider) expiry() time.Time {
+	return time.Now().Add(-time.Duration(p.maxlifetime) * time.Second)
+}
+
+func (p *sqliteSessionProvider) SessionRead(sid string) (session.Store, error) {
+	var stored StoredSession
+	err := p.db.Where("id = ? AND updated_at > ?", sid, p.expiry()).First(&stored).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, errors.Wrap(err, "SessionRead")
+	}
+	values := make(map[interface{}]interface{})
+	if len(stored.Data) != 0 {
+		values, err = session.DecodeGob(stored.Data)
+		if err != nil {
+			return nil, errors.Wrap(err, "SessionRead")
+		}
+	}
+	return &sqliteSessionStore{provider: p, sid: sid, values: values}, nil
+}
+
+func (p *sqliteSessionProvider) SessionExist(sid string) bool {
+	var count int
+	p.db.Model(&StoredSession{}).Where("id = ? AND updated_at > ?", sid, p.expiry()).Count(&count)
+	return count != 0
+}
+
+func (p *sqliteSessionProvider) SessionRegenerate(oldsid, sid string) (session.Store, error) {
+	err := p.db.Model(&StoredSession{}).Where("id = ?", oldsid).UpdateColumn("id", sid).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "SessionRegenerate")
+	}
+	return p.SessionRead(sid)
+}
+
+func (p *sqliteSessionProvider) SessionDestroy(sid string) error {
+	err := p.db.Delete(StoredSession{}, "id = ?", sid).Error
+	if err != nil {
+		return errors.Wrap(err, "SessionDestroy")
+	}
+	return nil
+}
+
+func (p *sqliteSessionProvider) SessionAll() int {
+	var count int
+	p.db.Model(&StoredSession{}).Where("updated_at > ?", p.expiry()).Count(&count)
+	return count
+}
+
+func (p *sqliteSessionProvider) SessionGC() {
+	p.db.Delete(StoredSession{}, "updated_at <= ?", p.expiry())
+}
+
+type sqliteSessionStore struct {
+	provider *sqliteSessionProvider
+	sid      string
+	lock     sync.RWMutex
+	values   map[interface{}]interface{}
+}
+
+func (s *sqliteSessionStore) Set(key, value interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.values[key] = value
+	return nil
+}
+
+func (s *sqliteSessionStore) Get(key interface{}) interface{} {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.values[key]
+}
+
+func (s *sqliteSessionStore) Delete(key interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func (s *sqliteSessionStore) SessionID() string {
+	return s.sid
+}
+
+// SessionRelease saves the session. Sessions are saved even when unchanged so
+// that their lifetime starts over.
+func (s *sqliteSessionStore) SessionRelease(w http.ResponseWriter) {
+	s.lock.RLock()
+	data, err := session.EncodeGob(s.values)
+	s.lock.RUnlock()
+	if err != nil {
+		return
+	}
+	s.provider.db.Save(&StoredSession{ID: s.sid, Data: data, UpdatedAt: time.Now()})
+}
+
+func (s *sqliteSessionStore) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.values = make(map[interface{}]interface{})
+	return nil
+}
+
+// adminSessionTouchInterval limits how often the LastSeen of an admin session
+// is written.
+const adminSessionTouchInterval = time.Minute
+
+func StoreAdminSession(db *gorm.DB, adminSession AdminSession) (err error) {
+	now := time.Now()
+	adminSession.LastSeen = now
+	err = db.Where(AdminSession{SID: adminSession.SID}).Assign(adminSession).FirstOrCreate(&adminSession).Error
+	if err != nil {
+		err = errors.Wrap(err, "StoreAdminSession")
+		return
+	}
+	return
+}
+
+// TouchAdminSession updates the time the admin session sid was last used.
+func TouchAdminSession(db *gorm.DB, sid string) (err error) {
+	now := time.Now()
+	err = db.Model(&AdminSession{}).Where("sid = ? AND last_seen < ?", sid, now.Add(-adminSessionTouchInterval)).
+		UpdateColumn("last_seen", now).Error
+	if err != nil {
+		err = errors.Wrap(err, "TouchAdminSession")
+		return
+	}
+	return
+}
+
+// FindAdminSessions lists the admin sessions still known to manager,
+// forgetting the ones that expired.
+func FindAdminSessions(db *gorm.DB, manager *session.Manager) (sessions []AdminSession, err error) {
+	var all []AdminSession
+	err = db.Order("last_seen desc").Find(&all).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindAdminSessions")
+		return
+	}
+	sessions = []AdminSession{}
+	for _, s := range all {
+		if manager.GetProvider().SessionExist(s.SID) {
+			sessions = append(sessions, s)
+		} else {
+			db.Delete(&s)
+		}
+	}
+	return
+}
+
+// RemoveAdminSession revokes the admin session id, destroying the session
+// itself.
+func RemoveAdminSession(db *gorm.DB, manager *session.Manager, id uint) (err error) {
+	var adminSession AdminSession
+	err = db.Where("id = ?", id).First(&adminSession).Error
+	if err == nil {
+		err = manager.GetProvider().SessionDestroy(adminSession.SID)
+	}
+	if err == nil {
+		err = db.Delete(&adminSession).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "RemoveAdminSession")
+		return
+	}
+	return
+}
+
+// RemoveAdminSessionBySID forgets the admin session sid on logout.
+func RemoveAdminSessionBySID(db *gorm.DB, sid string) (err error) {
+	err = db.Delete(AdminSession{}, "sid = ?", sid).Error
+	if err != nil {
+		err = errors.Wrap(err, "RemoveAdminSessionBySID")
+		return
+	}
+	return
+}
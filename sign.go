@@ -0,0 +1,40 @@
+package kotori
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+)
+
+// sign authenticates message with an HMAC keyed by the SECRET of GlobCfg.
+// The purpose is mixed in so that a signature issued for one use cannot be
+// replayed for another.
+func sign(purpose string, message string) string {
+	mac := hmac.New(sha256.New, []byte(GlobCfg.SECRET))
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature reports in constant time whether signature is the one sign
+// returns for purpose and message.
+func verifySignature(purpose string, message string, signature string) bool {
+	return hmac.Equal([]byte(sign(purpose, message)), []byte(signature))
+}
+
+// RandomSecret returns a new random secret suitable for the secret key of
+// config.toml.
+func RandomSecret() (secret string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		err = errors.Wrap(err, "RandomSecret")
+		return
+	}
+	secret = hex.EncodeToString(b)
+	return
+}
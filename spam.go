@@ -0,0 +1,309 @@
+package kotori
+
+import (
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// SpamScore records what one check of the SpamFilter thought of a comment,
+// from 0 for clean to 1 for certain spam.
+type SpamScore struct {
+	ID        uint    `gorm:"AUTO_INCREMENT" json:"id"`
+	CommentID uint    `gorm:"not null;index" json:"comment_id"`
+	Check     string  `json:"check"`
+	Score     float64 `json:"score"`
+}
+
+// SpamToken holds how many spam and ham comments a token was seen in, for the
+// naive Bayes classifier. The row with the empty token counts the comments
+// themselves.
+type SpamToken struct {
+	Token string `gorm:"primary_key" json:"token"`
+	Spam  int    `gorm:"not null;default:0" json:"spam"`
+	Ham   int    `gorm:"not null;default:0" json:"ham"`
+}
+
+const (
+	SpamClassSpam = "spam"
+	SpamClassHam  = "ham"
+)
+
+// SpamCheck scores a comment before it is stored. form holds the values the
+// comment was submitted with.
+type SpamCheck interface {
+	CheckSpam(db *gorm.DB, comment Comment, form url.Values) (score float64, err error)
+}
+
+// SpamCheckFunc adapts a function to SpamCheck.
+type SpamCheckFunc func(db *gorm.DB, comment Comment, form url.Values) (score float64, err error)
+
+func (f SpamCheckFunc) CheckSpam(db *gorm.DB, comment Comment, form url.Values) (score float64, err error) {
+	return f(db, comment, form)
+}
+
+// SpamFilter runs every registered check on a comment. Their scores are
+// combined as independent probabilities, so that a single confident check or
+// several weak ones make a comment suspicious.
+type SpamFilter struct {
+	names  []string
+	checks []SpamCheck
+}
+
+// NewSpamFilter returns a filter running the built-in checks configured in cfg.
+func NewSpamFilter(cfg SpamConfig) *SpamFilter {
+	f := &SpamFilter{}
+	f.Register("bayes", SpamCheckFunc(bayesCheck))
+	f.Register("links", linkCheck(cfg.MAX_LINKS))
+	if len(cfg.KEYWORDS) != 0 {
+		f.Register("keywords", keywordCheck(cfg.KEYWORDS))
+	}
+	if cfg.HONEYPOT != "" {
+		f.Register("honeypot", honeypotCheck(cfg.HONEYPOT))
+	}
+	if cfg.DUPLICATE_HOURS > 0 {
+		f.Register("duplicate", duplicateCheck(time.Duration(cfg.DUPLICATE_HOURS)*time.Hour))
+	}
+	return f
+}
+
+// Register adds check to the filter under name, replacing any check already
+// registered with that name.
+func (f *SpamFilter) Register(name string, check SpamCheck) {
+	for i := range f.names {
+		if f.names[i] == name {
+			f.checks[i] = check
+			return
+		}
+	}
+	f.names = append(f.names, name)
+	f.checks = append(f.checks, check)
+}
+
+// Check runs the checks on comment and returns their combined score and the
+// score of each check. A nil filter finds nothing.
+func (f *SpamFilter) Check(db *gorm.DB, comment Comment, form url.Values) (score float64, scores []SpamScore, err error) {
+	if f == nil {
+		return
+	}
+	clean := 1.0
+	for i, check := range f.checks {
+		var s float64
+		s, err = check.CheckSpam(db, comment, form)
+		if err != nil {
+			err = errors.Wrap(err, "SpamFilter.Check")
+			return
+		}
+		s = math.Max(0, math.Min(1, s))
+		scores = append(scores, SpamScore{Check: f.names[i], Score: s})
+		clean *= 1 - s
+	}
+	score = 1 - clean
+	return
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\bhttps?://|\bwww\.|<a\s`)
+
+// linkCheck suspects comments with more than max links, more so the more
+// links there are.
+func linkCheck(max int) SpamCheck {
+	return SpamCheckFunc(func(db *gorm.DB, comment Comment, form url.Values) (score float64, err error) {
+		excess := len(linkPattern.FindAllStringIndex(comment.Content, -1)) - max
+		if excess > 0 {
+			score = 1 - math.Pow(0.5, float64(excess))
+		}
+		return
+	})
+}
+
+// keywordCheck looks for blacklisted words in the comment and its author.
+// Each distinct keyword found halves the chance the comment is clean.
+func keywordCheck(keywords []string) SpamCheck {
+	return SpamCheckFunc(func(db *gorm.DB, comment Comment, form url.Values) (score float64, err error) {
+		text := strings.ToLower(strings.Join([]string{comment.Content, comment.User.Name, comment.User.Email, comment.User.Website}, "\n"))
+		hits := 0
+		for _, keyword := range keywords {
+			if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" && strings.Contains(text, keyword) {
+				hits++
+			}
+		}
+		score = 1 - math.Pow(0.5, float64(hits))
+		return
+	})
+}
+
+// honeypotCheck flags comments that filled in field, a form field hidden from
+// humans by the front-end.
+func honeypotCheck(field string) SpamCheck {
+	return SpamCheckFunc(func(db *gorm.DB, comment Comment, form url.Values) (score float64, err error) {
+		if strings.TrimSpace(form.Get(field)) != "" {
+			score = 1
+		}
+		return
+	})
+}
+
+// duplicateMinLength keeps short comments such as "Thanks!" from being
+// reported as duplicates.
+const duplicateMinLength = 20
+
+// duplicateCheck suspects comments whose content was already posted within
+// window, anywhere on the site.
+func duplicateCheck(window time.Duration) SpamCheck {
+	return SpamCheckFunc(func(db *gorm.DB, comment Comment, form url.Values) (score float64, err error) {
+		content := strings.TrimSpace(comment.Content)
+		if len([]rune(content)) < duplicateMinLength {
+			return
+		}
+		var count int
+		err = db.Model(&Comment{}).Where("TRIM(content) = ? AND created_at > ? AND id <> ?",
+			content, time.Now().Add(-window), comment.ID).Count(&count).Error
+		if err != nil {
+			err = errors.Wrap(err, "duplicateCheck")
+			return
+		}
+		if count > 0 {
+			score = 1 - 0.4*math.Pow(0.5, float64(count-1))
+		}
+		return
+	})
+}
+
+// bayesMinMessages is the number of spam and of ham comments the classifier
+// must have learned before it gives an opinion.
+const bayesMinMessages = 5
+
+// bayesMaxTokens is the number of most telling tokens the classifier decides on.
+const bayesMaxTokens = 15
+
+// spamTokens splits a comment into the distinct tokens the classifier learns.
+// CJK characters are tokens of their own.
+func spamTokens(comment Comment) []string {
+	text := strings.ToLower(comment.Content + " " + comment.User.Website)
+	seen := make(map[string]bool)
+	var tokens []string
+	add := func(token string) {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	var word []rune
+	flush := func() {
+		if len(word) >= 2 && len(word) <= 40 {
+			add(string(word))
+		}
+		word = word[:0]
+	}
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flush()
+			add(string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'' || r == '$':
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// bayesCheck is the naive Bayes classifier, trained by TrainSpam.
+func bayesCheck(db *gorm.DB, comment Comment, form url.Values) (score float64, err error) {
+	var total SpamToken
+	err = db.Where("token = ?", "").First(&total).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return 0, nil
+	}
+	if err != nil {
+		err = errors.Wrap(err, "bayesCheck")
+		return
+	}
+	if total.Spam < bayesMinMessages || total.Ham < bayesMinMessages {
+		return
+	}
+	tokens := spamTokens(comment)
+	if len(tokens) == 0 {
+		return
+	}
+	var known []SpamToken
+	err = db.Where("token IN (?)", tokens).Find(&known).Error
+	if err != nil {
+		err = errors.Wrap(err, "bayesCheck")
+		return
+	}
+	// Robinson's smoothed token probabilities, keeping the ones furthest
+	// from neutral.
+	probs := make([]float64, 0, len(known))
+	for _, t := range known {
+		spam := float64(t.Spam) / float64(total.Spam)
+		ham := float64(t.Ham) / float64(total.Ham)
+		if spam+ham == 0 {
+			continue
+		}
+		n := float64(t.Spam + t.Ham)
+		p := (0.5 + n*spam/(spam+ham)) / (1 + n)
+		probs = append(probs, math.Max(0.01, math.Min(0.99, p)))
+	}
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > bayesMaxTokens {
+		probs = probs[:bayesMaxTokens]
+	}
+	eta := 0.0
+	for _, p := range probs {
+		eta += math.Log(1-p) - math.Log(p)
+	}
+	score = 1 / (1 + math.Exp(eta))
+	return
+}
+
+// TrainSpam teaches the classifier that comment is of class, SpamClassSpam or
+// SpamClassHam, undoing what it learned from the comment before if needed.
+// The class learned is remembered on the comment.
+func TrainSpam(db *gorm.DB, comment Comment, class string) (err error) {
+	if comment.SpamClass == class {
+		return
+	}
+	if comment.SpamClass != "" {
+		err = learnSpamTokens(db, comment, comment.SpamClass, -1)
+	}
+	if err == nil {
+		err = learnSpamTokens(db, comment, class, 1)
+	}
+	if err == nil {
+		err = db.Model(&Comment{}).Where("id = ?", comment.ID).UpdateColumn("spam_class", class).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "TrainSpam")
+		return
+	}
+	return
+}
+
+func learnSpamTokens(db *gorm.DB, comment Comment, class string, delta int) (err error) {
+	column := "ham"
+	if class == SpamClassSpam {
+		column = "spam"
+	}
+	for _, token := range append([]string{""}, spamTokens(comment)...) {
+		err = db.Exec("INSERT OR IGNORE INTO spam_tokens (token, spam, ham) VALUES (?, 0, 0)", token).Error
+		if err == nil {
+			err = db.Exec("UPDATE spam_tokens SET "+column+" = MAX(0, "+column+" + ?) WHERE token = ?", delta, token).Error
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,102 @@
+package kotori
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// CommentCursor points to the rest of the replies of FatherID, listed oldest
+// first by ListComment and ListThread from Cursor, or after OffsetID.
+type CommentCursor struct {
+	FatherID uint   `json:"father_id"`
+	OffsetID uint   `json:"offset_id"`
+	Cursor   string `json:"cursor"`
+}
+
+// CommentNode is a comment with the first of its replies nested. MoreReplies
+// points to those left out.
+type CommentNode struct {
+	Comment
+	Replies     []*CommentNode `json:"replies"`
+	MoreReplies *CommentCursor `json:"more_replies,omitempty"`
+}
+
+// FindCommentThreads returns a page of the comments replying to fatherID, as
+// FindComments does, each with up to maxReplies of its replies nested, and so
+// on down to depth levels of replies.
+func FindCommentThreads(db *gorm.DB, commentZoneID uint, fatherID uint, offsetID uint, depth int,
+	maxReplies int) (threads []*CommentNode, err error) {
+	threads, _, err = FindCommentThreadPage(db, offsetCommentQuery(commentZoneID, fatherID, offsetID), depth,
+		maxReplies)
+	return
+}
+
+// FindCommentThreadPage returns the page of comments selected by query, each
+// with up to maxReplies of its replies nested, oldest first, and so on down
+// to depth levels of replies, with the cursor of the next page. Whatever the
+// number of comments, it takes five queries for the page and five per level:
+// the comments, their User and their ReplyUser, their ReplyCount and their
+// Reactions.
+func FindCommentThreadPage(db *gorm.DB, query CommentQuery, depth int, maxReplies int) (threads []*CommentNode,
+	next string, err error) {
+	roots, next, err := FindCommentPage(db, query)
+	if err != nil {
+		err = errors.Wrap(err, "FindCommentThreadPage")
+		return
+	}
+	threads = make([]*CommentNode, len(roots))
+	for i := range roots {
+		threads[i] = &CommentNode{Comment: roots[i], Replies: []*CommentNode{}}
+	}
+	level := threads
+	for d := 0; d < depth && maxReplies > 0 && len(level) != 0; d++ {
+		nodes := make(map[uint]*CommentNode, len(level))
+		var fathers []uint
+		for _, node := range level {
+			nodes[node.ID] = node
+			if node.ReplyCount != 0 {
+				fathers = append(fathers, node.ID)
+			}
+		}
+		if len(fathers) == 0 {
+			break
+		}
+		var replies []Comment
+		// Number the replies of each comment to keep the first maxReplies.
+		err = db.Where("id IN (SELECT id FROM (SELECT id, ROW_NUMBER() OVER "+
+			"(PARTITION BY father_id ORDER BY id) AS n FROM comments WHERE status = ? AND father_id IN (?) AND "+
+			visibleCommentSQL("comments")+") "+
+			"WHERE n <= ?)", CommentStatusApproved, fathers, maxReplies).
+			Preload("User").Preload("ReplyUser").Order("id asc").Find(&replies).Error
+		if err == nil {
+			err = fillCommentCounts(db, replies)
+		}
+		if err != nil {
+			err = errors.Wrap(err, "FindCommentThreadPage")
+			return
+		}
+		level = nil
+		for i := range replies {
+			node := &CommentNode{Comment: replies[i], Replies: []*CommentNode{}}
+			father := nodes[node.FatherID]
+			father.Replies = append(father.Replies, node)
+			level = append(level, node)
+		}
+	}
+	pointToMoreReplies(threads)
+	return
+}
+
+// pointToMoreReplies sets the MoreReplies of the nodes missing replies.
+func pointToMoreReplies(nodes []*CommentNode) {
+	for _, node := range nodes {
+		if node.ReplyCount > len(node.Replies) {
+			node.MoreReplies = &CommentCursor{FatherID: node.ID}
+			if len(node.Replies) != 0 {
+				node.MoreReplies.OffsetID = node.Replies[len(node.Replies)-1].ID
+				node.MoreReplies.Cursor = OffsetCursor(CommentSortOldest, node.MoreReplies.OffsetID)
+			}
+		}
+		pointToMoreReplies(node.Replies)
+	}
+}
@@ -0,0 +1,140 @@
+package kotori
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// Scopes an APIToken may be granted. The permissions they grant are listed
+// in scopePermissions.
+const (
+	ScopePostWrite       = "post:write"
+	ScopeCommentModerate = "comment:moderate"
+	ScopeIndexWrite      = "index:write"
+)
+
+var tokenScopes = []string{ScopePostWrite, ScopeCommentModerate, ScopeIndexWrite}
+
+// apiTokenPrefix marks kotori tokens, so that leaked ones are easy to spot.
+const apiTokenPrefix = "kotori_"
+
+// apiTokenTouchInterval limits how often the LastUsed of a token is written.
+const apiTokenTouchInterval = time.Minute
+
+// APIToken grants scripts access to the admin routes of its scopes with an
+// Authorization: Bearer header. Only the SHA-256 hash of the token is stored,
+// the token itself is shown once when it is created.
+type APIToken struct {
+	ID        uint       `gorm:"AUTO_INCREMENT" json:"id"`
+	Name      string     `gorm:"not null" json:"name"`
+	Hash      string     `gorm:"not null;unique_index" json:"-"`
+	Scopes    string     `gorm:"not null" json:"-"`
+	ScopeList []string   `gorm:"-" json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	LastUsed  *time.Time `json:"last_used"`
+}
+
+func (token *APIToken) AfterFind() (err error) {
+	token.ScopeList = strings.Fields(token.Scopes)
+	return
+}
+
+// HasScope reports whether the token was granted scope.
+func (token APIToken) HasScope(scope string) bool {
+	for _, s := range token.ScopeList {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func validTokenScope(scope string) bool {
+	for _, s := range tokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashAPIToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// StoreAPIToken creates a token with the name, scopes and expiry of token,
+// returning the secret to hand to the client.
+func StoreAPIToken(db *gorm.DB, token *APIToken) (secret string, err error) {
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		err = errors.Wrap(err, "StoreAPIToken")
+		return
+	}
+	secret = apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	token.Hash = hashAPIToken(secret)
+	token.Scopes = strings.Join(token.ScopeList, " ")
+	err = db.Create(token).Error
+	if err != nil {
+		err = errors.Wrap(err, "StoreAPIToken")
+		return
+	}
+	return
+}
+
+// FindAPITokenBySecret looks up the unexpired token secret, recording that it
+// was used.
+func FindAPITokenBySecret(db *gorm.DB, secret string) (token APIToken, err error) {
+	now := time.Now()
+	err = db.Where("hash = ? AND (expires_at IS NULL OR expires_at > ?)", hashAPIToken(secret), now).
+		First(&token).Error
+	if err == nil && (token.LastUsed == nil || now.Sub(*token.LastUsed) > apiTokenTouchInterval) {
+		token.LastUsed = &now
+		err = db.Model(&APIToken{}).Where("id = ?", token.ID).UpdateColumn("last_used", now).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "FindAPITokenBySecret")
+		return
+	}
+	return
+}
+
+func FindAPITokens(db *gorm.DB) (tokens []APIToken, err error) {
+	err = db.Order("id desc").Find(&tokens).Error
+	if err != nil {
+		err = errors.Wrap(err, "FindAPITokens")
+		return
+	}
+	return
+}
+
+func RemoveAPIToken(db *gorm.DB, id uint) (err error) {
+	err = db.Where("id = ?", id).First(&APIToken{}).Error
+	if err == nil {
+		err = db.Delete(APIToken{}, "id = ?", id).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "RemoveAPIToken")
+		return
+	}
+	return
+}
+
+// bearerToken returns the token of the Authorization header of req, if any.
+func bearerToken(req *http.Request) (secret string, ok bool) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[7:]), true
+}
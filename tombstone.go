@@ -0,0 +1,177 @@
+package kotori
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// visibleCommentSQL keeps the tombstones of removed comments out of listings,
+// but for those with an approved reply left somewhere under them, which hold
+// their thread together.
+func visibleCommentSQL(table string) string {
+	return "(" + table + ".removed_at IS NULL OR EXISTS (WITH RECURSIVE descendants(id) AS " +
+		"(SELECT children.id FROM comments AS children WHERE children.father_id = " + table + ".id UNION " +
+		"SELECT children.id FROM comments AS children JOIN descendants ON children.father_id = descendants.id) " +
+		"SELECT 1 FROM comments AS children WHERE children.id IN descendants " +
+		"AND children.status = 'approved' AND children.removed_at IS NULL))"
+}
+
+// RemoveComment turns the comment id, and its replies down the thread if
+// thread, into tombstones: replies stay listed under them, while their content
+// and author are hidden from visitors. The Rank of their users changes
+// according to rules. The tombstones keep id as their RemovalID, so that they
+// are restored together by RestoreRemovedComment, or deleted for good by
+// PurgeRemovedComments.
+func RemoveComment(db *gorm.DB, id uint, thread bool, rules RankConfig) (err error) {
+	tx := db.Begin()
+	var comments []Comment
+	err = tx.Where("id = ? AND removed_at IS NULL", id).Find(&comments).Error
+	if err == nil && len(comments) == 0 {
+		err = gorm.ErrRecordNotFound
+	}
+	if err == nil && thread {
+		var ids []uint
+		ids, err = commentThreadIDs(tx, id)
+		if err == nil {
+			err = tx.Where("id IN (?) AND removed_at IS NULL", ids).Find(&comments).Error
+		}
+	}
+	now := time.Now()
+	for i := 0; err == nil && i < len(comments); i++ {
+		previous := comments[i]
+		err = tx.Model(&comments[i]).UpdateColumns(map[string]interface{}{"removed_at": &now, "removal_id": id}).Error
+		if err == nil {
+			err = adjustCommentRank(tx, rules, previous, comments[i])
+		}
+		if err == nil {
+			err = removeFromSearchIndex(tx, SearchTypeComment, comments[i].ID)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "RemoveComment")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		err = errors.Wrap(err, "RemoveComment")
+		return
+	}
+	return
+}
+
+// RestoreRemovedComment brings back the removed comment id, with the replies
+// under it that share its RemovalID, and the Rank their users had for them
+// under rules. Replies removed on their own, before or after, stay removed.
+func RestoreRemovedComment(db *gorm.DB, id uint, rules RankConfig) (err error) {
+	tx := db.Begin()
+	var comment Comment
+	err = tx.Where("id = ? AND removed_at IS NOT NULL", id).First(&comment).Error
+	var ids []uint
+	if err == nil {
+		ids, err = commentThreadIDs(tx, id)
+	}
+	var comments []Comment
+	if err == nil {
+		err = tx.Where("id IN (?) AND removed_at IS NOT NULL AND removal_id = ?", ids, comment.RemovalID).
+			Find(&comments).Error
+	}
+	for i := 0; err == nil && i < len(comments); i++ {
+		previous := comments[i]
+		err = tx.Model(&comments[i]).UpdateColumns(map[string]interface{}{"removed_at": gorm.Expr("NULL"),
+			"removal_id": 0}).Error
+		if err == nil {
+			comments[i].RemovedAt = nil
+			err = adjustCommentRank(tx, rules, previous, comments[i])
+		}
+		if err == nil {
+			err = updateSearchIndex(tx, SearchTypeComment, comments[i].ID, "", comments[i].Content)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		err = errors.Wrap(err, "RestoreRemovedComment")
+		return
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		err = errors.Wrap(err, "RestoreRemovedComment")
+		return
+	}
+	return
+}
+
+// FillRemovalIDs gives a RemovalID to the tombstones left before they were
+// stored: each comment removed at the same time as its parent shares the
+// RemovalID of the parent, any other its own id.
+func FillRemovalIDs(db *gorm.DB) (err error) {
+	err = db.Model(&Comment{}).Where("removed_at IS NOT NULL AND removal_id = 0").
+		UpdateColumn("removal_id", gorm.Expr("-id")).Error
+	for affected := int64(1); err == nil && affected > 0; {
+		result := db.Exec("UPDATE comments SET removal_id = (SELECT parent.removal_id FROM comments AS parent " +
+			"WHERE parent.id = comments.father_id) WHERE removal_id < 0 AND EXISTS (SELECT 1 FROM comments AS parent " +
+			"WHERE parent.id = comments.father_id AND parent.removed_at = comments.removed_at " +
+			"AND parent.removal_id != comments.removal_id)")
+		err, affected = result.Error, result.RowsAffected
+	}
+	if err == nil {
+		err = db.Model(&Comment{}).Where("removal_id < 0").UpdateColumn("removal_id", gorm.Expr("-removal_id")).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "FillRemovalIDs")
+		return
+	}
+	return
+}
+
+// commentThreadIDs returns the id of the comment id and of all its replies,
+// however deep.
+func commentThreadIDs(db *gorm.DB, id uint) (ids []uint, err error) {
+	var rows []struct{ ID uint }
+	err = db.Raw("WITH RECURSIVE thread(id) AS (SELECT ? UNION "+
+		"SELECT comments.id FROM comments JOIN thread ON comments.father_id = thread.id) "+
+		"SELECT id FROM thread", id).Scan(&rows).Error
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+	}
+	return
+}
+
+// PurgeRemovedComments deletes for good the comments removed before before,
+// once no reply is left under them, and returns how many were deleted.
+func PurgeRemovedComments(db *gorm.DB, before time.Time) (count int64, err error) {
+	for {
+		var ids []uint
+		err = db.Model(&Comment{}).Where("removed_at < ? AND NOT EXISTS "+
+			"(SELECT 1 FROM comments AS children WHERE children.father_id = comments.id)", before).
+			Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			break
+		}
+		tx := db.Begin()
+		for _, model := range []interface{}{SpamScore{}, CommentVote{}, CommentReaction{}, CommentRevision{}} {
+			if err == nil {
+				err = tx.Delete(model, "comment_id IN (?)", ids).Error
+			}
+		}
+		if err == nil {
+			err = tx.Delete(Comment{}, "id IN (?)", ids).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			break
+		}
+		err = tx.Commit().Error
+		if err != nil {
+			break
+		}
+		count += int64(len(ids))
+	}
+	if err != nil {
+		err = errors.Wrap(err, "PurgeRemovedComments")
+		return
+	}
+	return
+}
@@ -0,0 +1,62 @@
+package kotori
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestoreRemovedCommentByRemovalID(t *testing.T) {
+	db := openTestDB(t)
+	root := storeTestComment(t, db, Comment{Content: "root"})
+	reply := storeTestComment(t, db, Comment{FatherID: root.ID, Content: "reply"})
+	own := storeTestComment(t, db, Comment{FatherID: root.ID, Content: "removed on its own"})
+	nested := storeTestComment(t, db, Comment{FatherID: reply.ID, Content: "nested"})
+	if err := RemoveComment(db, own.ID, false, RankConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveComment(db, root.ID, true, RankConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	// Removals within the same clock tick must not be told apart by time.
+	if err := db.Model(&Comment{}).Where("removed_at IS NOT NULL").
+		UpdateColumn("removed_at", time.Unix(0, 0)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreRemovedComment(db, root.ID, RankConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		id      uint
+		removed bool
+	}{{root.ID, false}, {reply.ID, false}, {nested.ID, false}, {own.ID, true}} {
+		var comment Comment
+		if err := db.First(&comment, c.id).Error; err != nil {
+			t.Fatal(err)
+		}
+		if (comment.RemovedAt != nil) != c.removed {
+			t.Errorf("comment %d: removed at %v", c.id, comment.RemovedAt)
+		}
+	}
+}
+
+func TestFillRemovalIDs(t *testing.T) {
+	db := openTestDB(t)
+	at := time.Unix(100, 0)
+	root := storeTestComment(t, db, Comment{Content: "root", RemovedAt: &at})
+	reply := storeTestComment(t, db, Comment{FatherID: root.ID, Content: "reply", RemovedAt: &at})
+	nested := storeTestComment(t, db, Comment{FatherID: reply.ID, Content: "nested", RemovedAt: &at})
+	earlier := time.Unix(50, 0)
+	own := storeTestComment(t, db, Comment{FatherID: root.ID, Content: "own", RemovedAt: &earlier})
+	if err := FillRemovalIDs(db); err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range map[uint]uint{root.ID: root.ID, reply.ID: root.ID, nested.ID: root.ID, own.ID: own.ID} {
+		var comment Comment
+		if err := db.First(&comment, id).Error; err != nil {
+			t.Fatal(err)
+		}
+		if comment.RemovalID != want {
+			t.Errorf("comment %d: got removal id %d, want %d", id, comment.RemovalID, want)
+		}
+	}
+}
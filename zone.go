@@ -0,0 +1,168 @@
+package kotori
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// States of a comment zone. Closed zones take no new comments; locked ones
+// take no votes or reactions either.
+const (
+	CommentZoneOpen   = "open"
+	CommentZoneClosed = "closed"
+	CommentZoneLocked = "locked"
+)
+
+var (
+	ErrCommentZoneTaken  = errors.New("a comment zone already exists for this post or index")
+	ErrCommentZoneLocked = errors.New("comment zone is locked")
+)
+
+// CommentZone holds the comments about a Post or an Index, or about anything
+// else the front-end shows when both ids are 0. An open zone closes by itself
+// CloseAfterDays after its post is published, or after it is created when it
+// has no post, unless CloseAfterDays is 0. Open tells whether the zone takes
+// new comments now.
+type CommentZone struct {
+	ID             uint       `gorm:"AUTO_INCREMENT" json:"id"`
+	PostID         uint       `gorm:"not null;default:0;index" json:"post_id"`
+	IndexID        uint       `gorm:"not null;default:0;index" json:"index_id"`
+	State          string     `gorm:"not null;default:'open'" json:"state"`
+	CloseAfterDays int        `gorm:"not null;default:0" json:"close_after_days"`
+	ClosesAt       *time.Time `gorm:"-" json:"closes_at"`
+	Open           bool       `gorm:"-" json:"open"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+func ValidCommentZoneState(state string) bool {
+	return state == CommentZoneOpen || state == CommentZoneClosed || state == CommentZoneLocked
+}
+
+// fillState sets the ClosesAt and the Open of zone, given when its post, if
+// any, was published. Zones are loaded along with their post where possible,
+// so that listings take no query per zone.
+func (zone *CommentZone) fillState(publishedAt *time.Time) {
+	zone.ClosesAt = nil
+	if zone.CloseAfterDays > 0 {
+		opened := &zone.CreatedAt
+		if zone.PostID != 0 {
+			opened = publishedAt
+		}
+		if opened != nil {
+			closesAt := opened.AddDate(0, 0, zone.CloseAfterDays)
+			zone.ClosesAt = &closesAt
+		}
+	}
+	zone.Open = zone.State == CommentZoneOpen && (zone.ClosesAt == nil || time.Now().Before(*zone.ClosesAt))
+}
+
+func FindCommentZone(db *gorm.DB, id uint) (zone CommentZone, err error) {
+	err = db.Where("id = ?", id).First(&zone).Error
+	var posts []Post
+	if err == nil && zone.PostID != 0 {
+		err = db.Select("published_at").Where("id = ?", zone.PostID).Find(&posts).Error
+	}
+	if err != nil {
+		err = errors.Wrap(err, "FindCommentZone")
+		return
+	}
+	var publishedAt *time.Time
+	if len(posts) != 0 {
+		publishedAt = posts[0].PublishedAt
+	}
+	zone.fillState(publishedAt)
+	return
+}
+
+// closeCommentZones closes the open comment zones matching where, such as
+// those of a post or an index being removed. Locked ones stay locked.
+func closeCommentZones(db *gorm.DB, where string, args ...interface{}) error {
+	return db.Model(&CommentZone{}).Where(where, args...).Where("state = ?", CommentZoneOpen).
+		UpdateColumn("state", CommentZoneClosed).Error
+}
+
+// StoreCommentZone creates a comment zone, for the post or the index of zone
+// if any, which must not have one already.
+func StoreCommentZone(db *gorm.DB, zone CommentZone) (zone_new CommentZone, err error) {
+	if zone.State == "" {
+		zone.State = CommentZoneOpen
+	}
+	var count int
+	if zone.PostID != 0 {
+		err = db.Where("id = ?", zone.PostID).First(&Post{}).Error
+		if err == nil {
+			err = db.Model(&CommentZone{}).Where("post_id = ?", zone.PostID).Count(&count).Error
+		}
+	} else if zone.IndexID != 0 {
+		err = db.Where("id = ?", zone.IndexID).First(&Index{}).Error
+		if err == nil {
+			err = db.Model(&CommentZone{}).Where("index_id = ?", zone.IndexID).Count(&count).Error
+		}
+	}
+	if err == nil && count != 0 {
+		err = ErrCommentZoneTaken
+	}
+	if err == nil {
+		err = db.Create(&zone).Error
+	}
+	if err == nil {
+		zone_new, err = FindCommentZone(db, zone.ID)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "StoreCommentZone")
+		return
+	}
+	return
+}
+
+// UpdateCommentZone sets the state of the comment zone id unless empty, and
+// its CloseAfterDays unless nil.
+func UpdateCommentZone(db *gorm.DB, id uint, state string, closeAfterDays *int) (zone_new CommentZone, err error) {
+	err = db.Where("id = ?", id).First(&zone_new).Error
+	fields := map[string]interface{}{}
+	if state != "" {
+		fields["state"] = state
+	}
+	if closeAfterDays != nil {
+		fields["close_after_days"] = *closeAfterDays
+	}
+	if err == nil && len(fields) != 0 {
+		err = db.Model(&zone_new).Updates(fields).Error
+	}
+	if err == nil {
+		zone_new, err = FindCommentZone(db, id)
+	}
+	if err != nil {
+		err = errors.Wrap(err, "UpdateCommentZone")
+		return
+	}
+	return
+}
+
+// checkCommentZoneUnlocked returns ErrCommentZoneLocked if the comment zone
+// id is locked.
+func checkCommentZoneUnlocked(db *gorm.DB, id uint) (err error) {
+	var zone CommentZone
+	err = db.Where("id = ?", id).First(&zone).Error
+	if err == nil && zone.State == CommentZoneLocked {
+		err = ErrCommentZoneLocked
+	}
+	return
+}
+
+// FillCommentZones creates an open comment zone for every zone id used by
+// comments written before comment zones were stored.
+func FillCommentZones(db *gorm.DB) (err error) {
+	err = db.Exec("INSERT INTO comment_zones (id, created_at, updated_at) " +
+		"SELECT comment_zone_id, MIN(created_at), MIN(created_at) FROM comments " +
+		"WHERE comment_zone_id <> 0 AND comment_zone_id NOT IN (SELECT id FROM comment_zones) " +
+		"GROUP BY comment_zone_id").Error
+	if err != nil {
+		err = errors.Wrap(err, "FillCommentZones")
+		return
+	}
+	return
+}